@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// lockDataFile reports errLockUnsupported: advisory file locking is only
+// implemented for Unix systems.
+func lockDataFile(path string) (release func(), err error) {
+	return nil, errLockUnsupported
+}
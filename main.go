@@ -2,53 +2,336 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"embed"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 )
 
 // Configuration constants
 const (
-	port                = ":8910"
-	httpsPort           = ":8911"
-	dbFile              = "budget.dat"
-	usersFile           = "users"
-	logDir              = "/var/log/budget"
-	logFile             = logDir + "/transactions.csv"
-	unauthLogFile       = logDir + "/unauthorized.log"
-	certFile            = "cert.pem"
-	keyFile             = "key.pem"
-	maxBalance    int32 = 2000000000 // Cap at ~£20m to prevent overflow wrapping in 32-bit math
+	defaultHTTPAddr           = ":8910"
+	defaultHTTPSAddr          = ":8911"
+	defaultDBFile             = "budget.dat"
+	usersName                 = "users"
+	defaultLogDir             = "/var/log/budget"
+	transLogName              = "transactions.csv"
+	unauthLogName             = "unauthorized.log"
+	accessLogName             = "access.log"
+	certFile                  = "cert.pem"
+	keyFile                   = "key.pem"
+	lockSuffix                = ".lock"         // Appended to DBFile to name the instance lock file
+	dataMagic                 = "BUD2"          // Header of the legacy multi-account binary data file
+	dataVersion               = 2               // Current version of the JSON data file format
+	hashScheme                = "pbkdf2-sha256" // Prefix of hashed entries in the users file
+	hashIterations            = 100000          // PBKDF2 rounds for newly hashed tokens
+	hashKeyLength             = 32              // Bytes of derived key stored per token
+	balanceCeiling      int32 = 2000000000      // Hard cap preventing overflow wrapping in 32-bit math
+	maxBalanceMajor           = 20000000        // Balance cap in major units (~£20m at the default scale)
+	maxTransactionMajor       = 1000000         // Single transaction cap in major units (~£1m)
+	maxMinorUnits             = 4               // Largest supported number of decimal places
+	historyLimit              = 50              // Default number of entries returned by /history
+	maxUndoDepth              = 20              // Undoable actions remembered per user
+	maxRecurringRules         = 100             // Recurring rules across all users
+	maxRecurringCatchUp       = 24              // Missed occurrences applied per rule after downtime
+	maxDescriptionLen         = 100             // Characters allowed in a recurring rule description
+	maxMemoLen                = 200             // Characters allowed in a spend's memo
+	maxAccountNameLen         = 32              // Characters allowed in an account name
+	maxCategoryNameLen        = 32              // Characters allowed in a category added via /categories
+	maxCategories             = 100             // Categories that can be defined
+	maxBaselines              = 50              // Baselines each user may save via /baseline
+	maxBaselineNameLen        = 32              // Characters allowed in a baseline name
+	maxImportBytes            = 1 << 20         // Largest CSV body accepted by /import
+	maxRestoreBytes           = 16 << 20        // Largest data file accepted by /admin/restore
+	maxIdempotencyKey         = 255             // Characters allowed in an Idempotency-Key header
+	maxBatchItems             = 100             // Items allowed in one /spend/batch request
+	maxRequestIDLen           = 64              // Characters kept from an incoming X-Request-ID header
+	maxTokenLen               = 256             // Characters allowed in a users file token or user ID
+
+	transactionHeader  = "date,time,user,action,amount,category,account,seq,memo,sign" // Column names of the transaction CSV
+	defaultCategories  = "groceries,fuel,transport,bills,eating_out,shopping,health,entertainment,other"
+	defaultAccountName = "default" // Account used by the unscoped routes (/get, /spend, ...)
+	roleReadOnly       = "ro"      // Users file role that may only read
+	roleReadWrite      = "rw"      // Users file role that may also write (the default)
+	roleAdmin          = "admin"   // Users file role that may also use the /admin routes
+	spendSignOutflow   = "outflow" // A positive /spend amount reduces the balance (the default)
+	spendSignInflow    = "inflow"  // A /spend amount is signed as a balance change, so spends are negative
+	balanceModeStrict  = "strict"  // Budgets are positive and spends respect MinBalance (the default)
+	balanceModeDebt    = "debt"    // Budgets and balances may be negative down to -MaxBalance (BUDGET_DEBT_MODE)
+
+	categoryLimitWarn   = "warn"   // A spend over its category budget is applied and flagged (the default)
+	categoryLimitReject = "reject" // A spend over its category budget is refused
+
+	roundHalfUp   = "half_up"   // Halves of a minor unit round away from zero (the default)
+	roundHalfEven = "half_even" // Halves of a minor unit round to the even neighbour (banker's rounding)
+
+	transactionTimeLayout = "2006-01-02 15:04:05" // Date and time columns of a transaction, joined by a space
+
+	budgetModeAdjustBalance = "adjust_balance" // /set_budget moves the balance by the change in budget
+	budgetModePreserveSpent = "preserve_spent" // /set_budget keeps budget - balance unchanged
+	budgetModeRollover      = "rollover"       // /set_budget with "rollover": true starts a new period
+
+	defaultShutdownTimeout = 10 * time.Second // Override with BUDGET_SHUTDOWN_TIMEOUT
+	defaultLogKeep         = 5                // Override with BUDGET_LOG_KEEP
+	healthzLockTimeout     = time.Second      // Max wait for the state mutex in /healthz
+	recurringCheckInterval = time.Hour        // How often due recurring rules are checked
+	eventKeepAlive         = 15 * time.Second // Interval of the comments that keep idle /events streams open
+	defaultRateLimit       = 120              // Requests per user per minute; override with BUDGET_RATE_LIMIT
+	defaultLockoutFails    = 10               // Failed logins from one address before it is locked out; override with BUDGET_LOCKOUT_FAILS
+	defaultLockoutWindow   = 10 * time.Minute // Period over which failed logins are counted; override with BUDGET_LOCKOUT_WINDOW
+	defaultLockoutDuration = 15 * time.Minute // How long an address stays locked out; override with BUDGET_LOCKOUT_DURATION
+	defaultHashLimit       = 30               // Hashed token checks per address per minute; override with BUDGET_HASH_LIMIT
+	defaultMaxAccounts     = 10               // Named accounts per user; override with BUDGET_MAX_ACCOUNTS
+	defaultAlertThreshold  = 20               // Percent of the budget; override with BUDGET_ALERT_THRESHOLD
+	alertTimeout           = 5 * time.Second  // Max duration of a webhook POST
+	defaultBackupInterval  = 24 * time.Hour   // Override with BUDGET_BACKUP_INTERVAL
+	defaultFlushInterval   = time.Minute      // Override with BUDGET_FLUSH_INTERVAL
+	defaultBackupKeep      = 7                // Override with BUDGET_BACKUP_KEEP
+	defaultMaxBodyBytes    = 4096             // Override with BUDGET_MAX_BODY_BYTES
+	defaultMaxPage         = 1000             // Transactions listed per response; override with BUDGET_MAX_PAGE
+	defaultMaxPageBytes    = 1 << 20          // Bytes of transactions per response; override with BUDGET_MAX_PAGE_BYTES
+	defaultTxCacheSize     = 100000           // Transactions kept in memory; override with BUDGET_TX_CACHE_SIZE
+	defaultIdempotencyTTL  = 24 * time.Hour   // How long Idempotency-Key results are kept; override with BUDGET_IDEMPOTENCY_TTL
+	defaultConfirmTTL      = 2 * time.Minute  // How long a large spend awaits confirmation; override with BUDGET_CONFIRM_TTL
+	defaultLockWarn        = time.Second      // Wait for the state mutex that is logged; override with BUDGET_LOCK_WARN
+	defaultHeaderTimeout   = 5 * time.Second  // Override with BUDGET_READ_HEADER_TIMEOUT
+	defaultReadTimeout     = 30 * time.Second // Override with BUDGET_READ_TIMEOUT
+	defaultWriteTimeout    = 30 * time.Second // Override with BUDGET_WRITE_TIMEOUT
+	defaultIdleTimeout     = 2 * time.Minute  // Override with BUDGET_IDLE_TIMEOUT
+	defaultFileMode        = 0644             // Mode of created data and log files; override with BUDGET_FILE_MODE
+	defaultGzipMinBytes    = 1024             // Smallest response body compressed; override with BUDGET_GZIP_MIN_BYTES
+	defaultMaxUsers        = 1000             // Users loaded from the users file; override with BUDGET_MAX_USERS
+	pruneInterval          = 24 * time.Hour   // How often the transaction log is pruned when retention is set
 )
 
 // ThreadSafeLogger is a wrapper around os.File that ensures atomic writes
 // to a log file from multiple goroutines.
+// When created with NewRotatingLogger it also rotates the file by size.
 type ThreadSafeLogger struct {
-	mu   sync.Mutex
-	file *os.File
+	mu       sync.Mutex
+	file     *os.File
+	filename string
+	mode     os.FileMode
+	maxBytes int64 // Rotate once the file would exceed this size (0 disables rotation)
+	keep     int   // Number of rotated backups (<name>.1 ... <name>.keep) to retain
+	size     int64 // Bytes currently in the active file
+	dirty    bool  // Written to since the last Sync
 }
 
 // NewLogger creates specific logger for a given filename.
-// Opens file in append mode.
-func NewLogger(filename string) (*ThreadSafeLogger, error) {
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// Opens file in append mode, creating it with the given mode.
+func NewLogger(filename string, mode os.FileMode) (*ThreadSafeLogger, error) {
+	return NewRotatingLogger(filename, mode, 0, 0)
+}
+
+// NewRotatingLogger creates a logger that rotates the file to <name>.1,
+// <name>.2, ... once it grows past maxBytes, keeping at most 'keep' backups.
+// A maxBytes of 0 disables rotation.
+func NewRotatingLogger(filename string, mode os.FileMode, maxBytes int64, keep int) (*ThreadSafeLogger, error) {
+	f, size, err := openLogFile(filename, mode)
 	if err != nil {
 		return nil, err
 	}
-	return &ThreadSafeLogger{file: f}, nil
+	return &ThreadSafeLogger{
+		file:     f,
+		filename: filename,
+		mode:     mode,
+		maxBytes: maxBytes,
+		keep:     keep,
+		size:     size,
+	}, nil
+}
+
+// openLogFile opens filename for appending and returns its current size.
+// A missing file is created with the given mode (less the umask).
+func openLogFile(filename string, mode os.FileMode) (*os.File, int64, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
 }
 
 // Log writes a formatted string to the file with mutex protection.
 func (l *ThreadSafeLogger) Log(format string, args ...interface{}) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	fmt.Fprintf(l.file, format, args...)
+
+	line := fmt.Sprintf(format, args...)
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes {
+		// Rotation is best-effort: on failure keep writing to the current file
+		if err := l.rotate(); err != nil {
+			logError("Error rotating %s: %v", l.filename, err)
+		}
+	}
+
+	n, _ := io.WriteString(l.file, line)
+	l.size += int64(n)
+	l.dirty = true
+}
+
+// Sync commits what has been written since the last call to stable storage.
+// It does nothing if there is no such write.
+func (l *ThreadSafeLogger) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// LogRecord writes fields as one CSV record, quoting any field that contains
+// a comma, quote or newline, so every record reads back intact.
+func (l *ThreadSafeLogger) LogRecord(fields ...string) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(fields)
+	cw.Flush()
+	l.Log("%s", buf.String())
+}
+
+// rotate shifts the backups up by one, moves the active file to <name>.1 and
+// opens a fresh file in its place. Caller must hold l.mu.
+func (l *ThreadSafeLogger) rotate() error {
+	// The file may have been truncated externally (e.g. logrotate copytruncate),
+	// so confirm the real size before rotating.
+	if info, err := l.file.Stat(); err == nil {
+		l.size = info.Size()
+		if l.size == 0 {
+			return nil
+		}
+	}
+
+	if l.keep <= 0 {
+		// No backups requested: start the file over
+		if err := l.file.Truncate(0); err != nil {
+			return err
+		}
+		l.size = 0
+		return nil
+	}
+
+	for i := l.keep - 1; i >= 1; i-- {
+		src := fmt.Sprintf("%s.%d", l.filename, i)
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", l.filename, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Rename while still open so that, if reopening fails, writes simply
+	// continue into the rotated file instead of being lost.
+	if err := os.Rename(l.filename, l.filename+".1"); err != nil {
+		return err
+	}
+	f, size, err := openLogFile(l.filename, l.mode)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = f
+	l.size = size
+	return nil
+}
+
+// Rewrite replaces the contents of the active file with what fn writes to w
+// after reading the current contents from r. The new contents go to a
+// temporary file that is synced and renamed over the original, so a crash
+// leaves one or the other intact, and l.mu is held throughout so no record
+// can be written in between. Logging then continues in the new file.
+func (l *ThreadSafeLogger) Rewrite(fn func(r io.Reader, w io.Writer) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	src, err := os.Open(l.filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpFile := l.filename + ".tmp"
+	dst, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, l.mode)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		dst.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	bw := bufio.NewWriter(dst)
+	if err := fn(bufio.NewReader(src), bw); err != nil {
+		return fail(err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := dst.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, l.filename); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	f, size, err := openLogFile(l.filename, l.mode)
+	if err != nil {
+		// The old handle still points at the replaced file; keep using it
+		// rather than lose records, until the next rotation or restart
+		return err
+	}
+	l.file.Close()
+	l.file = f
+	l.size = size
+	l.dirty = false
+	return nil
 }
 
 // Close closes the underlying file handle.
@@ -58,365 +341,8228 @@ func (l *ThreadSafeLogger) Close() {
 	l.file.Close()
 }
 
-// Server holds the application state.
-// It uses a mutex to protect the shared 'balance' and 'budget' variables.
-//
-// Fields:
-// - mu: Mutex for thread-safe access to balance and budget.
-// - balance: Current account balance in pence.
-// - budget: Target budget in pence.
-// - users: Map of authorized user IDs.
-// - transLogger: Logger for financial transactions.
-// - unauthLogger: Logger for unauthorized access attempts.
-type Server struct {
-	mu           sync.Mutex
-	balance      int32 // Current account balance in pence
-	budget       int32 // Stores the initial budget
-	users        map[string]bool
-	transLogger  *ThreadSafeLogger
-	unauthLogger *ThreadSafeLogger
-}
+// jsonLogs selects the format of the operational log (see setLogFormat).
+// It is set once at startup, before any goroutine logs.
+var jsonLogs bool
 
-// SetRequest defines the JSON payload for setting the absolute balance.
-type SetRequest struct {
-	Amount int32 `json:"amount"`
+// logLine is one operational log entry in JSON format.
+type logLine struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	Error string `json:"error,omitempty"` // Text of the first error argument, if any
+	ReqID string `json:"request_id,omitempty"`
 }
 
-// SpendRequest defines the JSON payload for spending (reducing) the balance.
-type SpendRequest struct {
-	Amount int32 `json:"amount"`
+// setLogFormat switches the operational log between plain text (the default,
+// as written by the standard log package) and JSON lines ("json").
+func setLogFormat(format string) {
+	switch strings.ToLower(format) {
+	case "json":
+		jsonLogs = true
+		log.SetFlags(0)
+	case "text":
+		jsonLogs = false
+	default:
+		logWarn("unknown log format %q, using text", format)
+	}
 }
 
-// SetBudgetRequest defines the JSON payload for setting the budget.
-type SetBudgetRequest struct {
-	Budget int32 `json:"budget"`
+// logInfo, logWarn and logError write an operational log entry at their level.
+// These, not the transaction or unauthorized logs, are what goes to stderr.
+func logInfo(format string, args ...interface{})  { logAt("info", "", format, args...) }
+func logWarn(format string, args ...interface{})  { logAt("warn", "", format, args...) }
+func logError(format string, args ...interface{}) { logAt("error", "", format, args...) }
+
+// logRequestError writes an error entry tagged with the ID of the request
+// being handled, so it can be matched with what the client saw.
+func logRequestError(r *http.Request, format string, args ...interface{}) {
+	logAt("error", requestID(r), format, args...)
 }
 
-// GetResponse defines the JSON response for the get endpoint.
-type GetResponse struct {
-	Balance int32 `json:"balance"`
-	Budget  int32 `json:"budget"`
+// logFatal writes an error entry and exits, like log.Fatalf.
+func logFatal(format string, args ...interface{}) {
+	logAt("fatal", "", format, args...)
+	os.Exit(1)
 }
 
-func main() {
-	// Initialize Loggers (thread-safe for concurrent access)
-	tl, err := NewLogger(logFile)
-	if err != nil {
-		log.Fatalf("Failed to open transaction log: %v", err)
+// logAt formats and writes one entry. In text mode warnings keep their
+// historical "Warning: " prefix and the other levels are unmarked; a request
+// ID, if any, comes first in brackets.
+func logAt(level, reqID, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !jsonLogs {
+		if level == "warn" {
+			msg = "Warning: " + msg
+		}
+		if reqID != "" {
+			msg = "[" + reqID + "] " + msg
+		}
+		log.Print(msg)
+		return
 	}
-	defer tl.Close()
 
-	ul, err := NewLogger(unauthLogFile)
+	entry := logLine{Time: time.Now().UTC().Format(time.RFC3339Nano), Level: level, Msg: msg, ReqID: reqID}
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			entry.Error = err.Error()
+			break
+		}
+	}
+	line, err := json.Marshal(entry)
 	if err != nil {
-		log.Fatalf("Failed to open unauthorized log: %v", err)
+		log.Print(msg)
+		return
 	}
-	defer ul.Close()
+	log.Print(string(line))
+}
 
-	// Initialize Server state
-	srv := &Server{
-		users:        make(map[string]bool),
-		transLogger:  tl,
-		unauthLogger: ul,
-	}
+// Account holds the balance and budget belonging to a single user.
+//
+// CategoryBudgets caps the spends of each listed category per budget cycle,
+// on top of Budget. The map is replaced, never modified in place, so copies
+// of an Account taken under s.mu stay valid after it is released.
+type Account struct {
+	Balance         int32            `json:"balance"`                    // Current account balance in pence
+	Budget          int32            `json:"budget"`                     // Stores the initial budget
+	Version         int64            `json:"version"`                    // Incremented on every change; exposed as the ETag
+	Currency        string           `json:"currency,omitempty"`         // ISO 4217 code; empty means Config.Currency
+	CategoryBudgets map[string]int32 `json:"category_budgets,omitempty"` // Budget per category, in pence
+}
 
-	// Load valid users whitelist
-	if err := srv.loadUsers(); err != nil {
-		log.Fatalf("Failed to load users: %v", err)
-	}
+// dataFile is the versioned JSON document persisted in Config.DBFile.
+// New fields can be added freely; bump dataVersion only for changes that
+// older builds would misinterpret.
+//
+// Version 1 stored a single account per user; version 2 keys the accounts by
+// user ID and then by account name. Categories is absent until first saved,
+// in which case the configured categories apply. Seq is the last transaction
+// sequence number issued. Stats holds the lifetime counters of /stats.
+type dataFile struct {
+	Version    int                            `json:"version"`
+	Accounts   map[string]map[string]*Account `json:"accounts"`
+	Recurring  []*RecurringRule               `json:"recurring,omitempty"`
+	Categories []string                       `json:"categories,omitempty"`
+	Seq        int64                          `json:"seq,omitempty"`
+	Baselines  []*Baseline                    `json:"baselines,omitempty"`
+	Stats      *Stats                         `json:"stats,omitempty"`
+}
 
-	// Load existing balance/budget from disk
-	if err := srv.loadData(); err != nil {
-		log.Printf("Warning: Failed to load data (starting at 0): %v", err)
-	}
+// Stats holds the lifetime activity counters reported by /stats. Unlike
+// /summary they are never reset by a budget cycle, and unlike /metrics
+// they are persisted so they survive restarts. SpentTotal is in minor units.
+type Stats struct {
+	Spends        int64 `json:"spends"`
+	SpentTotal    int64 `json:"spent_total"`
+	Sets          int64 `json:"sets"`
+	BudgetChanges int64 `json:"budget_changes"`
+	Unauthorized  int64 `json:"unauthorized"`
+}
 
-	// Route Handlers with Auth Middleware
-	http.HandleFunc("/get", srv.authMiddleware(srv.handleGet))
-	http.HandleFunc("/set", srv.authMiddleware(srv.handleSet))
-	http.HandleFunc("/spend", srv.authMiddleware(srv.handleSpend))
-	http.HandleFunc("/set_budget", srv.authMiddleware(srv.handleSetBudget))
+// Baseline is a named snapshot of one of a user's accounts, saved with
+// POST /baseline and compared against the current state by /diff. Seq is the
+// last transaction sequence number issued when it was taken, so the
+// transactions since are those with a higher Seq.
+type Baseline struct {
+	Name    string `json:"name"`
+	User    string `json:"user"`
+	Account string `json:"account"`
+	Balance int32  `json:"balance"`
+	Budget  int32  `json:"budget"`
+	Seq     int64  `json:"seq"`
+	Created string `json:"created"` // RFC 3339
+}
 
-	// start the HTTP server in a background goroutine
-	go func() {
-		log.Printf("HTTP Server listening on %s", port)
-		if err := http.ListenAndServe(port, nil); err != nil {
-			log.Fatalf("HTTP Server failed: %v", err)
-		}
-	}()
+// RecurringRule debits a fixed amount from a user's default account on the
+// same day every month. Day is clamped to the end of shorter months; NextDue
+// (YYYY-MM-DD) is the next date on which the rule will be applied.
+type RecurringRule struct {
+	ID          int    `json:"id"`
+	User        string `json:"user"`
+	Amount      int32  `json:"amount"`
+	Category    string `json:"category,omitempty"`
+	Day         int    `json:"day"`
+	Description string `json:"description,omitempty"`
+	NextDue     string `json:"next_due"`
+}
 
-	// Check for SSL certificates to optionally start HTTPS server
-	// This enables PWA installation on mobile devices.
-	if _, err := os.Stat(certFile); err == nil {
-		log.Printf("HTTPS Server listening on %s", httpsPort)
-		if err := http.ListenAndServeTLS(httpsPort, certFile, keyFile, nil); err != nil {
-			log.Fatalf("HTTPS Server failed: %v", err)
+// Config holds runtime settings resolved from environment variables at startup.
+//
+// Fields:
+// - HTTPAddr: Listen address of the HTTP server (BUDGET_HTTP_ADDR).
+// - HTTPSAddr: Listen address of the HTTPS server (BUDGET_HTTPS_ADDR).
+// - DataDir: Base directory for relative DBFile and LogDir values and the users file (BUDGET_DATA_DIR).
+// - DBFile: Path of the data file (BUDGET_DB_FILE).
+// - UsersFile: Path of the users file or directory, in DataDir.
+// - MaxUsers: Users that may be loaded from the users file (BUDGET_MAX_USERS).
+// - UsersLenient: Ignore users past MaxUsers with a warning instead of failing (BUDGET_USERS_LENIENT).
+// - LogDir: Directory holding the transaction, unauthorized and access logs (BUDGET_LOG_DIR).
+// - TransLogFile, UnauthLogFile, AccessLogFile: Log file paths, derived from LogDir.
+// - AccessLog: Record successful reads in AccessLogFile (BUDGET_ACCESS_LOG).
+// - ShutdownTimeout: How long to wait for in-flight requests on shutdown (BUDGET_SHUTDOWN_TIMEOUT).
+// - HeaderTimeout: Time allowed to read a request's headers (BUDGET_READ_HEADER_TIMEOUT).
+// - ReadTimeout: Time allowed to read a whole request, body included (BUDGET_READ_TIMEOUT).
+// - WriteTimeout: Time allowed to write a response (BUDGET_WRITE_TIMEOUT).
+// - IdleTimeout: How long a keep-alive connection may wait for its next request (BUDGET_IDLE_TIMEOUT).
+// - MinBalance: Lowest balance a spend may leave, in pence (BUDGET_MIN_BALANCE).
+// - AllowOverdraft: Disables the MinBalance floor entirely (BUDGET_ALLOW_OVERDRAFT).
+// - DebtMode: Allows negative budgets and balances down to -MaxBalance, with no floor, for tracking debts (BUDGET_DEBT_MODE).
+// - SpendSign: Sign convention of /spend amounts, spendSignOutflow or spendSignInflow (BUDGET_SPEND_SIGN).
+// - Currency: ISO 4217 code of accounts that don't set their own (BUDGET_CURRENCY).
+// - RatesFile: JSON exchange-rate table used by /convert, empty to disable (BUDGET_RATES_FILE).
+// - MinorUnits: Decimal places of the currency, e.g. 2 for pence (BUDGET_MINOR_UNITS).
+// - MaxBalance: Largest allowed balance/budget in minor units, derived from MinorUnits.
+// - MaxTransaction: Largest single transaction in minor units, capped by MinorUnits (BUDGET_MAX_TRANSACTION).
+// - DailySpendLimit: Total a user may spend in any 24 hours, 0 for no limit (BUDGET_DAILY_SPEND_LIMIT).
+// - ConfirmAbove: Spends larger than this must be confirmed with X-Confirm-Token, 0 to disable (BUDGET_CONFIRM_ABOVE).
+// - ConfirmTTL: How long a confirmation token stays valid (BUDGET_CONFIRM_TTL).
+// - CategoryLimit: What happens to spends over their category budget, categoryLimitWarn or categoryLimitReject (BUDGET_CATEGORY_LIMIT).
+// - Rounding: How computed amounts are rounded to whole minor units, roundHalfUp or roundHalfEven (BUDGET_ROUNDING).
+// - DefaultBudget: Budget and balance given to each user on first run, 0 to disable (BUDGET_DEFAULT).
+// - LogMaxBytes: Size at which the log files are rotated, 0 to disable (BUDGET_LOG_MAX_BYTES).
+// - LogKeep: Number of rotated log backups to keep (BUDGET_LOG_KEEP).
+// - RetentionDays: Days of transactions kept in the transaction log, 0 to keep all (BUDGET_LOG_RETENTION_DAYS).
+// - LogArchive: Move pruned transactions to a dated archive file rather than deleting them (BUDGET_LOG_ARCHIVE).
+// - FileMode: Permissions of created data, backup and log files, in octal (BUDGET_FILE_MODE).
+// - StrictPerms: Refuse to start if the data or log files are world-writable (BUDGET_STRICT_PERMS).
+// - RateLimit: Requests allowed per user per minute, 0 to disable (BUDGET_RATE_LIMIT).
+// - LockoutFails: Failed logins from one address within LockoutWindow that lock it out, 0 to disable (BUDGET_LOCKOUT_FAILS).
+// - LockoutWindow: Period over which failed logins are counted (BUDGET_LOCKOUT_WINDOW).
+// - LockoutDuration: How long a locked out address is refused before its token is checked (BUDGET_LOCKOUT_DURATION).
+// - HashLimit: Hashed token checks (PBKDF2 derivations) allowed per address per minute, 0 to disable (BUDGET_HASH_LIMIT).
+// - AuthFailDelay: Least time a failed login is held before its 401, plus up to as much again at random, 0 to disable (BUDGET_AUTH_FAIL_DELAY).
+// - Categories: Initial spend categories, comma-separated, until changed via /categories (BUDGET_CATEGORIES).
+// - MetricsAuth: Require a valid token for /metrics (BUDGET_METRICS_AUTH).
+// - MaxAccounts: Named accounts each user may create (BUDGET_MAX_ACCOUNTS).
+// - AlertWebhook: URL notified when a balance drops below the threshold, empty to disable (BUDGET_ALERT_WEBHOOK).
+// - AlertThreshold: Percentage of the budget that triggers the alert (BUDGET_ALERT_THRESHOLD).
+// - BackupInterval: How often the data file is backed up, 0 to disable (BUDGET_BACKUP_INTERVAL).
+// - FlushInterval: How often unsaved state and the logs are flushed to disk, 0 to disable (BUDGET_FLUSH_INTERVAL).
+// - BackupKeep: Number of data file backups to keep (BUDGET_BACKUP_KEEP).
+// - MaxBodyBytes: Largest JSON request body accepted (BUDGET_MAX_BODY_BYTES).
+// - MaxPage: Most transactions or log entries listed in one response, whatever ?limit= asks for (BUDGET_MAX_PAGE).
+// - MaxPageBytes: Most bytes of transaction JSON in one response, beyond which the list is truncated (BUDGET_MAX_PAGE_BYTES).
+// - GzipMinBytes: Smallest report response compressed for clients accepting gzip (BUDGET_GZIP_MIN_BYTES).
+// - TxCacheSize: Most recent transactions kept in memory for reporting (BUDGET_TX_CACHE_SIZE).
+// - TLSMinVersion: Lowest TLS version the HTTPS server accepts, e.g. "1.2" (BUDGET_TLS_MIN_VERSION).
+// - LockWarn: Wait for the state lock above which a request logs a warning, 0 to disable (BUDGET_LOCK_WARN).
+// - IdempotencyTTL: How long the result of a request with an Idempotency-Key is replayed (BUDGET_IDEMPOTENCY_TTL).
+// - CORSOrigins: Origins allowed to call the API from a browser, empty for any (BUDGET_CORS_ORIGINS).
+// - TrustedProxies: Proxy addresses whose X-Forwarded-For/X-Real-IP headers are believed, empty to ignore them (BUDGET_TRUSTED_PROXIES).
+// - CycleDay: Day of the month on which a budget period starts, clamped in short months (BUDGET_CYCLE_DAY).
+// - TimeZone: IANA name of the zone of logged dates and times and of budget cycles, empty for local time (BUDGET_TIMEZONE).
+// - ServeApp: Serve the web app on / alongside the API (BUDGET_SERVE_APP).
+// - StaticDir: Directory the web app is served from, empty for the copy built into the binary (BUDGET_STATIC_DIR).
+type Config struct {
+	HTTPAddr        string
+	HTTPSAddr       string
+	DataDir         string
+	DBFile          string
+	UsersFile       string
+	MaxUsers        int
+	UsersLenient    bool
+	LogDir          string
+	TransLogFile    string
+	UnauthLogFile   string
+	AccessLogFile   string
+	AccessLog       bool
+	ShutdownTimeout time.Duration
+	HeaderTimeout   time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	MinBalance      int32
+	AllowOverdraft  bool
+	DebtMode        bool
+	SpendSign       string
+	Currency        string
+	RatesFile       string
+	MinorUnits      int32
+	MaxBalance      int32
+	MaxTransaction  int32
+	DailySpendLimit int64
+	ConfirmAbove    int32
+	ConfirmTTL      time.Duration
+	CategoryLimit   string
+	Rounding        string
+	DefaultBudget   int32
+	LogMaxBytes     int64
+	LogKeep         int
+	RetentionDays   int
+	LogArchive      bool
+	FileMode        os.FileMode
+	StrictPerms     bool
+	RateLimit       int
+	LockoutFails    int
+	LockoutWindow   time.Duration
+	LockoutDuration time.Duration
+	HashLimit       int
+	AuthFailDelay   time.Duration
+	Categories      map[string]bool
+	MetricsAuth     bool
+	MaxAccounts     int
+	AlertWebhook    string
+	AlertThreshold  int
+	BackupInterval  time.Duration
+	FlushInterval   time.Duration
+	BackupKeep      int
+	CycleDay        int
+	MaxBodyBytes    int64
+	MaxPage         int
+	MaxPageBytes    int
+	GzipMinBytes    int
+	TxCacheSize     int
+	TLSMinVersion   uint16
+	CORSOrigins     map[string]bool
+	TrustedProxies  []netip.Prefix
+	IdempotencyTTL  time.Duration
+	LockWarn        time.Duration
+	ServeApp        bool
+	StaticDir       string
+	TimeZone        string
+}
+
+// logConfig prints the effective configuration so operators can confirm
+// which settings are in use.
+func (c Config) logConfig() {
+	logInfo("Config: http=%s https=%s data=%s db=%s users=%s logs=%s",
+		c.HTTPAddr, c.HTTPSAddr, c.DataDir, c.DBFile, c.UsersFile, c.LogDir)
+	logInfo("Config: currency=%s minor_units=%d min_balance=%d overdraft=%t debt_mode=%t rate_limit=%d/min spend_sign=%s",
+		c.Currency, c.MinorUnits, c.MinBalance, c.AllowOverdraft, c.DebtMode, c.RateLimit, c.SpendSign)
+	logInfo("Config: max_transaction=%d daily_spend_limit=%d default_budget=%d confirm_above=%d category_limit=%s rounding=%s",
+		c.MaxTransaction, c.DailySpendLimit, c.DefaultBudget, c.ConfirmAbove, c.CategoryLimit, c.Rounding)
+	logInfo("Config: backup_interval=%s backup_keep=%d flush_interval=%s", c.BackupInterval, c.BackupKeep, c.FlushInterval)
+	if c.TimeZone != "" {
+		logInfo("Config: time_zone=%s", c.TimeZone)
+	}
+	logInfo("Config: file_mode=%04o strict_perms=%t", c.FileMode, c.StrictPerms)
+	logInfo("Config: log_max_bytes=%d log_keep=%d log_retention_days=%d log_archive=%t access_log=%t",
+		c.LogMaxBytes, c.LogKeep, c.RetentionDays, c.LogArchive, c.AccessLog)
+	logInfo("Config: max_users=%d users_lenient=%t", c.MaxUsers, c.UsersLenient)
+	logInfo("Config: max_page=%d max_page_bytes=%d", c.MaxPage, c.MaxPageBytes)
+	logInfo("Config: lockout_fails=%d lockout_window=%s lockout_duration=%s hash_limit=%d/min auth_fail_delay=%s",
+		c.LockoutFails, c.LockoutWindow, c.LockoutDuration, c.HashLimit, c.AuthFailDelay)
+	logInfo("Config: read_header_timeout=%s read_timeout=%s write_timeout=%s idle_timeout=%s lock_warn=%s",
+		c.HeaderTimeout, c.ReadTimeout, c.WriteTimeout, c.IdleTimeout, c.LockWarn)
+	if len(c.CORSOrigins) > 0 {
+		origins := make([]string, 0, len(c.CORSOrigins))
+		for o := range c.CORSOrigins {
+			origins = append(origins, o)
 		}
-	} else {
-		log.Println("No cert.pem/key.pem found. HTTPS disabled. Running in HTTP-only mode.")
-		// Block forever to keep the main goroutine alive
-		select {}
+		sort.Strings(origins)
+		logInfo("Config: cors_origins=%s", strings.Join(origins, ","))
+	}
+	if len(c.TrustedProxies) > 0 {
+		proxies := make([]string, len(c.TrustedProxies))
+		for i, p := range c.TrustedProxies {
+			proxies[i] = p.String()
+		}
+		logInfo("Config: trusted_proxies=%s", strings.Join(proxies, ","))
+	}
+	if c.AlertWebhook != "" {
+		logInfo("Config: alert webhook enabled below %d%% of budget", c.AlertThreshold)
+	}
+	switch {
+	case !c.ServeApp:
+		logInfo("Config: web app not served")
+	case c.StaticDir != "":
+		logInfo("Config: web app served from %s", c.StaticDir)
+	default:
+		logInfo("Config: built-in web app served")
 	}
 }
 
-// loadUsers reads the 'users' whitelist file into a map.
-func (s *Server) loadUsers() error {
-	file, err := os.Open(usersFile)
-	if err != nil {
-		return err
+// loadConfig reads the configuration from the environment, falling back to
+// the defaults for anything unset or invalid.
+func loadConfig() Config {
+	cfg := Config{
+		HTTPAddr:        envString("BUDGET_HTTP_ADDR", defaultHTTPAddr),
+		HTTPSAddr:       envString("BUDGET_HTTPS_ADDR", defaultHTTPSAddr),
+		DataDir:         envString("BUDGET_DATA_DIR", "."),
+		DBFile:          envString("BUDGET_DB_FILE", defaultDBFile),
+		LogDir:          envString("BUDGET_LOG_DIR", defaultLogDir),
+		MaxUsers:        int(envInt32("BUDGET_MAX_USERS", defaultMaxUsers)),
+		UsersLenient:    envBool("BUDGET_USERS_LENIENT", false),
+		ShutdownTimeout: envDuration("BUDGET_SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+		HeaderTimeout:   envDuration("BUDGET_READ_HEADER_TIMEOUT", defaultHeaderTimeout),
+		ReadTimeout:     envDuration("BUDGET_READ_TIMEOUT", defaultReadTimeout),
+		WriteTimeout:    envDuration("BUDGET_WRITE_TIMEOUT", defaultWriteTimeout),
+		IdleTimeout:     envDuration("BUDGET_IDLE_TIMEOUT", defaultIdleTimeout),
+		MinBalance:      envInt32("BUDGET_MIN_BALANCE", 0),
+		AllowOverdraft:  envBool("BUDGET_ALLOW_OVERDRAFT", false),
+		DebtMode:        envBool("BUDGET_DEBT_MODE", false),
+		SpendSign:       strings.ToLower(envString("BUDGET_SPEND_SIGN", spendSignOutflow)),
+		Currency:        strings.ToUpper(envString("BUDGET_CURRENCY", "GBP")),
+		RatesFile:       envString("BUDGET_RATES_FILE", ""),
+		MinorUnits:      envInt32("BUDGET_MINOR_UNITS", 2),
+		MaxTransaction:  envInt32("BUDGET_MAX_TRANSACTION", 0),
+		DailySpendLimit: envInt64("BUDGET_DAILY_SPEND_LIMIT", 0),
+		ConfirmAbove:    envInt32("BUDGET_CONFIRM_ABOVE", 0),
+		ConfirmTTL:      envDuration("BUDGET_CONFIRM_TTL", defaultConfirmTTL),
+		CategoryLimit:   strings.ToLower(envString("BUDGET_CATEGORY_LIMIT", categoryLimitWarn)),
+		Rounding:        strings.ToLower(envString("BUDGET_ROUNDING", roundHalfUp)),
+		DefaultBudget:   envInt32("BUDGET_DEFAULT", 0),
+		LogMaxBytes:     envInt64("BUDGET_LOG_MAX_BYTES", 0),
+		LogKeep:         int(envInt32("BUDGET_LOG_KEEP", defaultLogKeep)),
+		RetentionDays:   int(envInt32("BUDGET_LOG_RETENTION_DAYS", 0)),
+		AccessLog:       envBool("BUDGET_ACCESS_LOG", false),
+		LogArchive:      envBool("BUDGET_LOG_ARCHIVE", false),
+		FileMode:        envFileMode("BUDGET_FILE_MODE", defaultFileMode),
+		StrictPerms:     envBool("BUDGET_STRICT_PERMS", false),
+		RateLimit:       int(envInt32("BUDGET_RATE_LIMIT", defaultRateLimit)),
+		LockoutFails:    int(envInt32("BUDGET_LOCKOUT_FAILS", defaultLockoutFails)),
+		LockoutWindow:   envDuration("BUDGET_LOCKOUT_WINDOW", defaultLockoutWindow),
+		LockoutDuration: envDuration("BUDGET_LOCKOUT_DURATION", defaultLockoutDuration),
+		HashLimit:       int(envInt32("BUDGET_HASH_LIMIT", defaultHashLimit)),
+		AuthFailDelay:   envDuration("BUDGET_AUTH_FAIL_DELAY", 0),
+		Categories:      make(map[string]bool),
+		MetricsAuth:     envBool("BUDGET_METRICS_AUTH", false),
+		MaxAccounts:     int(envInt32("BUDGET_MAX_ACCOUNTS", defaultMaxAccounts)),
+		AlertWebhook:    envString("BUDGET_ALERT_WEBHOOK", ""),
+		AlertThreshold:  int(envInt32("BUDGET_ALERT_THRESHOLD", defaultAlertThreshold)),
+		BackupInterval:  envDuration("BUDGET_BACKUP_INTERVAL", defaultBackupInterval),
+		FlushInterval:   envDuration("BUDGET_FLUSH_INTERVAL", defaultFlushInterval),
+		BackupKeep:      int(envInt32("BUDGET_BACKUP_KEEP", defaultBackupKeep)),
+		CycleDay:        int(envInt32("BUDGET_CYCLE_DAY", 1)),
+		MaxBodyBytes:    envInt64("BUDGET_MAX_BODY_BYTES", defaultMaxBodyBytes),
+		MaxPage:         int(envInt32("BUDGET_MAX_PAGE", defaultMaxPage)),
+		MaxPageBytes:    int(envInt32("BUDGET_MAX_PAGE_BYTES", defaultMaxPageBytes)),
+		GzipMinBytes:    int(envInt32("BUDGET_GZIP_MIN_BYTES", defaultGzipMinBytes)),
+		TxCacheSize:     int(envInt32("BUDGET_TX_CACHE_SIZE", defaultTxCacheSize)),
+		TLSMinVersion:   tls.VersionTLS12,
+		CORSOrigins:     make(map[string]bool),
+		IdempotencyTTL:  envDuration("BUDGET_IDEMPOTENCY_TTL", defaultIdempotencyTTL),
+		LockWarn:        envDuration("BUDGET_LOCK_WARN", defaultLockWarn),
+		ServeApp:        envBool("BUDGET_SERVE_APP", true),
+		StaticDir:       envString("BUDGET_STATIC_DIR", ""),
+		TimeZone:        envString("BUDGET_TIMEZONE", ""),
+	}
+	cfg.DBFile = resolvePath(cfg.DataDir, cfg.DBFile)
+	cfg.UsersFile = filepath.Join(cfg.DataDir, usersName)
+	if cfg.RatesFile != "" {
+		cfg.RatesFile = resolvePath(cfg.DataDir, cfg.RatesFile)
+	}
+	cfg.LogDir = resolvePath(cfg.DataDir, cfg.LogDir)
+	cfg.TransLogFile = filepath.Join(cfg.LogDir, transLogName)
+	cfg.UnauthLogFile = filepath.Join(cfg.LogDir, unauthLogName)
+	cfg.AccessLogFile = filepath.Join(cfg.LogDir, accessLogName)
+	if cfg.StaticDir != "" {
+		cfg.StaticDir = resolvePath(cfg.DataDir, cfg.StaticDir)
+		if fi, err := os.Stat(cfg.StaticDir); err != nil || !fi.IsDir() {
+			logWarn("BUDGET_STATIC_DIR %s is not a directory, serving the built-in web app", cfg.StaticDir)
+			cfg.StaticDir = ""
+		}
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		user := strings.TrimSpace(scanner.Text())
-		if user != "" {
-			s.users[user] = true
+	for _, c := range strings.Split(envString("BUDGET_CATEGORIES", defaultCategories), ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+			cfg.Categories[c] = true
 		}
 	}
-	return scanner.Err()
-}
 
-// loadData reads the data from disk.
-// Supports migration: 4 bytes (Balance) -> 8 bytes (Balance + Budget).
-// Returns nil if file doesn't exist (initial state).
-func (s *Server) loadData() error {
-	data, err := os.ReadFile(dbFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			s.balance = 0
-			s.budget = 0
-			return nil
+	for _, o := range strings.Split(envString("BUDGET_CORS_ORIGINS", ""), ",") {
+		if o = normalizeOrigin(o); o != "" {
+			cfg.CORSOrigins[o] = true
 		}
-		return err
+	}
+	if len(cfg.CORSOrigins) == 0 {
+		logWarn("BUDGET_CORS_ORIGINS is not set, allowing requests from any origin")
 	}
 
-	if len(data) == 4 {
-		// Migration: Old format (Balance only)
-		s.balance = int32(binary.LittleEndian.Uint32(data))
-		s.budget = 0
-		log.Println("Migrated database from 4 bytes to 8 bytes (added default Budget: 0)")
-		return s.saveData() // immediately save in new format
-	} else if len(data) == 8 {
-		// New format: Balance (4) + Budget (4)
-		s.balance = int32(binary.LittleEndian.Uint32(data[0:4]))
-		s.budget = int32(binary.LittleEndian.Uint32(data[4:8]))
-		return nil
+	for _, v := range strings.Split(envString("BUDGET_TRUSTED_PROXIES", ""), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		p, err := parsePrefix(v)
+		if err != nil {
+			logWarn("Ignoring invalid BUDGET_TRUSTED_PROXIES entry %q: %v", v, err)
+			continue
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, p)
 	}
 
-	return fmt.Errorf("invalid data length: %d", len(data))
-}
+	if cfg.MinorUnits < 0 || cfg.MinorUnits > maxMinorUnits {
+		logWarn("BUDGET_MINOR_UNITS must be between 0 and %d, using 2", maxMinorUnits)
+		cfg.MinorUnits = 2
+	}
 
-// saveData writes the current balance and budget to disk as 8 bytes little-endian.
-// It uses an atomic save strategy: write to temp file -> sync -> rename.
-func (s *Server) saveData() error {
-	data := make([]byte, 8)
-	binary.LittleEndian.PutUint32(data[0:4], uint32(s.balance))
-	binary.LittleEndian.PutUint32(data[4:8], uint32(s.budget))
+	if cfg.SpendSign != spendSignOutflow && cfg.SpendSign != spendSignInflow {
+		logWarn("BUDGET_SPEND_SIGN must be %q or %q, using %q", spendSignOutflow, spendSignInflow, spendSignOutflow)
+		cfg.SpendSign = spendSignOutflow
+	}
 
-	// 1. Write to a temporary file
-	tmpFile := dbFile + ".tmp"
-	f, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+	if cfg.RetentionDays < 0 {
+		logWarn("BUDGET_LOG_RETENTION_DAYS must not be negative, keeping all transactions")
+		cfg.RetentionDays = 0
 	}
-	// Careful: deferred Close() might mask write errors if we don't check carefully,
-	// but for atomic save, the critical part is Sync() and Rename().
-	// We will manually close before rename.
-	defer f.Close()
 
-	if _, err := f.Write(data); err != nil {
-		return err
+	if cfg.MaxUsers < 1 {
+		logWarn("BUDGET_MAX_USERS must be at least 1, using %d", defaultMaxUsers)
+		cfg.MaxUsers = defaultMaxUsers
 	}
 
-	// 2. Sync to ensure data is on physical disk
-	if err := f.Sync(); err != nil {
-		return err
+	if cfg.MaxAccounts < 1 {
+		logWarn("BUDGET_MAX_ACCOUNTS must be at least 1, using %d", defaultMaxAccounts)
+		cfg.MaxAccounts = defaultMaxAccounts
 	}
 
-	// Close explicitly before rename (required on Windows)
-	if err := f.Close(); err != nil {
-		return err
+	if cfg.AlertThreshold < 0 || cfg.AlertThreshold > 100 {
+		logWarn("BUDGET_ALERT_THRESHOLD must be between 0 and 100, using %d", defaultAlertThreshold)
+		cfg.AlertThreshold = defaultAlertThreshold
 	}
 
-	// 3. Atomic Rename
-	return os.Rename(tmpFile, dbFile)
-}
+	if cfg.BackupKeep < 1 {
+		logWarn("BUDGET_BACKUP_KEEP must be at least 1, using %d", defaultBackupKeep)
+		cfg.BackupKeep = defaultBackupKeep
+	}
 
-// authMiddleware enforces presence of a valid 'Authorization' header.
-// Responds with 401 Unauthorized if the user is not in the whitelist.
-func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// CORS headers for local testing convenience
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if cfg.CycleDay < 1 || cfg.CycleDay > 31 {
+		logWarn("BUDGET_CYCLE_DAY must be between 1 and 31, using 1")
+		cfg.CycleDay = 1
+	}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	if cfg.MaxBodyBytes < 1 {
+		logWarn("BUDGET_MAX_BODY_BYTES must be positive, using %d", defaultMaxBodyBytes)
+		cfg.MaxBodyBytes = defaultMaxBodyBytes
+	}
 
-		user := r.Header.Get("Authorization")
-		if user == "" || !s.users[user] {
-			s.logUnauthorized(user, r.RemoteAddr)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+	if v := os.Getenv("BUDGET_TLS_MIN_VERSION"); v != "" {
+		if version, ok := tlsVersions[v]; ok {
+			cfg.TLSMinVersion = version
+		} else {
+			logWarn("BUDGET_TLS_MIN_VERSION must be one of 1.0, 1.1, 1.2 or 1.3, using 1.2")
 		}
+	}
 
-		next(w, r)
+	if cfg.MaxTransaction < 0 {
+		logWarn("BUDGET_MAX_TRANSACTION must not be negative, using no limit")
+		cfg.MaxTransaction = 0
 	}
-}
 
-// handleGet returns the current balance and budget as JSON.
-func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if cfg.DailySpendLimit < 0 {
+		logWarn("BUDGET_DAILY_SPEND_LIMIT must not be negative, using no limit")
+		cfg.DailySpendLimit = 0
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if cfg.ConfirmAbove < 0 {
+		logWarn("BUDGET_CONFIRM_ABOVE must not be negative, not asking for confirmation")
+		cfg.ConfirmAbove = 0
+	}
 
-	resp := GetResponse{
-		Balance: s.balance,
-		Budget:  s.budget,
+	if cfg.ConfirmTTL <= 0 {
+		logWarn("BUDGET_CONFIRM_TTL must be positive, using %s", defaultConfirmTTL)
+		cfg.ConfirmTTL = defaultConfirmTTL
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
-}
 
-// handleSet sets the balance to a specific absolute value.
-func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if cfg.LockWarn < 0 {
+		logWarn("BUDGET_LOCK_WARN must not be negative, using %s", defaultLockWarn)
+		cfg.LockWarn = defaultLockWarn
 	}
 
-	var req SetRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
-		return
+	if cfg.CategoryLimit != categoryLimitWarn && cfg.CategoryLimit != categoryLimitReject {
+		logWarn("BUDGET_CATEGORY_LIMIT must be %q or %q, using %q", categoryLimitWarn, categoryLimitReject, categoryLimitWarn)
+		cfg.CategoryLimit = categoryLimitWarn
 	}
 
-	if req.Amount > maxBalance {
-		http.Error(w, "Amount exceeds limit", http.StatusBadRequest)
-		return
+	if cfg.Rounding != roundHalfUp && cfg.Rounding != roundHalfEven {
+		logWarn("BUDGET_ROUNDING must be %q or %q, using %q", roundHalfUp, roundHalfEven, roundHalfUp)
+		cfg.Rounding = roundHalfUp
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if cfg.LockoutFails < 0 {
+		logWarn("BUDGET_LOCKOUT_FAILS must not be negative, not locking out")
+		cfg.LockoutFails = 0
+	}
 
-	s.balance = req.Amount
-	if err := s.saveData(); err != nil {
-		log.Printf("Error saving data: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	if cfg.HashLimit < 0 {
+		logWarn("BUDGET_HASH_LIMIT must not be negative, not limiting hashed token checks")
+		cfg.HashLimit = 0
 	}
 
-	// Log the SET action
-	user := r.Header.Get("Authorization")
-	s.logTransaction(user, "SET", req.Amount)
+	if cfg.LockoutWindow <= 0 {
+		logWarn("BUDGET_LOCKOUT_WINDOW must be positive, using %s", defaultLockoutWindow)
+		cfg.LockoutWindow = defaultLockoutWindow
+	}
 
-	fmt.Fprintf(w, "%d", s.balance)
-}
+	if cfg.LockoutDuration <= 0 {
+		logWarn("BUDGET_LOCKOUT_DURATION must be positive, using %s", defaultLockoutDuration)
+		cfg.LockoutDuration = defaultLockoutDuration
+	}
 
-// handleSpend subtracts an amount from the balance.
-func (s *Server) handleSpend(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if cfg.AuthFailDelay < 0 {
+		logWarn("BUDGET_AUTH_FAIL_DELAY must not be negative, not delaying failed logins")
+		cfg.AuthFailDelay = 0
 	}
 
-	var req SpendRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
-		return
+	if cfg.MaxPage <= 0 {
+		logWarn("BUDGET_MAX_PAGE must be positive, using %d", defaultMaxPage)
+		cfg.MaxPage = defaultMaxPage
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if cfg.MaxPageBytes <= 0 {
+		logWarn("BUDGET_MAX_PAGE_BYTES must be positive, using %d", defaultMaxPageBytes)
+		cfg.MaxPageBytes = defaultMaxPageBytes
+	}
 
-	// Overflow/Data Safety Check
-	// Prevent massive transactions that could overflow int32 or are unreasonable.
-	if req.Amount > 100000000 || req.Amount < -100000000 { // Limit single transaction to ~£1m
-		http.Error(w, "Transaction too large", http.StatusBadRequest)
-		return
+	if cfg.IdempotencyTTL <= 0 {
+		logWarn("BUDGET_IDEMPOTENCY_TTL must be positive, using %s", defaultIdempotencyTTL)
+		cfg.IdempotencyTTL = defaultIdempotencyTTL
 	}
 
-	s.balance -= req.Amount
-	if err := s.saveData(); err != nil {
-		log.Printf("Error saving data: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	if cfg.GzipMinBytes < 0 {
+		logWarn("BUDGET_GZIP_MIN_BYTES must not be negative, using %d", defaultGzipMinBytes)
+		cfg.GzipMinBytes = defaultGzipMinBytes
 	}
 
-	// Log the SPEND action
-	user := r.Header.Get("Authorization")
-	s.logTransaction(user, "SPEND", req.Amount)
+	if cfg.TxCacheSize < 1 {
+		logWarn("BUDGET_TX_CACHE_SIZE must be positive, using %d", defaultTxCacheSize)
+		cfg.TxCacheSize = defaultTxCacheSize
+	}
+
+	// Derive the limits from the currency scale, never exceeding what
+	// 32-bit math can safely hold. A configured transaction limit may only
+	// lower the built-in one.
+	scale := int64(1)
+	for i := int32(0); i < cfg.MinorUnits; i++ {
+		scale *= 10
+	}
+	cfg.MaxBalance = int32(min(maxBalanceMajor*scale, int64(balanceCeiling)))
+	builtinMax := int32(min(maxTransactionMajor*scale, int64(balanceCeiling)))
+	if cfg.MaxTransaction == 0 || cfg.MaxTransaction > builtinMax {
+		cfg.MaxTransaction = builtinMax
+	}
 
-	fmt.Fprintf(w, "%d", s.balance)
+	if cfg.DefaultBudget < 0 || cfg.DefaultBudget > cfg.MaxBalance {
+		logWarn("BUDGET_DEFAULT must be between 0 and %d, ignoring it", cfg.MaxBalance)
+		cfg.DefaultBudget = 0
+	}
+	return cfg
 }
 
-// handleSetBudget sets the budget and adjusts the balance.
-func (s *Server) handleSetBudget(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// resolvePath returns path unchanged if it is absolute, and otherwise
+// relative to dir.
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
 	}
+	return filepath.Join(dir, path)
+}
 
-	var req SetBudgetRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid body", http.StatusBadRequest)
-		return
+// createDirs creates the data and log directories, with any missing
+// parents, so that a first run doesn't fail on them.
+func createDirs(cfg Config) error {
+	for _, dir := range []string{cfg.DataDir, filepath.Dir(cfg.DBFile), cfg.LogDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("cannot create directory %s: %w", dir, err)
+		}
 	}
+	return nil
+}
 
-	// Basic validation: Budget must be positive and reasonable
-	if req.Budget < 0 || req.Budget > maxBalance {
-		http.Error(w, "Invalid budget amount", http.StatusBadRequest)
-		return
+// selfCheck verifies at startup that the server can do its job: the data
+// directory is writable, the users file lists at least one user (loading
+// it), the data file (if any) can be parsed, the log files can be appended
+// to and are not world-writable (see StrictPerms), and the TLS certificate
+// pair (if cert.pem exists) is valid.
+// It logs one line per check and returns false if any of them failed.
+func (s *Server) selfCheck() bool {
+	type check struct {
+		what string
+		err  error
 	}
+	var checks []check
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	dataDir := filepath.Dir(s.cfg.DBFile)
+	checks = append(checks, check{"data directory " + dataDir + " is writable", checkWritableDir(dataDir)})
 
-	oldBudget := s.budget
-	diff := req.Budget - oldBudget
+	err := s.loadUsers()
+	checks = append(checks, check{fmt.Sprintf("users file %s lists %d user(s)", s.cfg.UsersFile, len(s.userOrder)), err})
 
-	s.budget = req.Budget
-	s.balance += diff
+	checks = append(checks, check{"data file " + s.cfg.DBFile + " is readable", s.checkDataFile()})
 
-	if err := s.saveData(); err != nil {
-		log.Printf("Error saving data: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	logFiles := []string{s.cfg.TransLogFile, s.cfg.UnauthLogFile}
+	if s.cfg.AccessLog {
+		logFiles = append(logFiles, s.cfg.AccessLogFile)
+	}
+	for _, name := range logFiles {
+		checks = append(checks, check{"log file " + name + " is writable", checkAppendable(name, s.cfg.FileMode)})
 	}
 
-	// Log the BUDGET_CHANGE action
-	user := r.Header.Get("Authorization")
-	s.logTransaction(user, "BUDGET_CHANGE", req.Budget)
+	// The logs hold tokens and the data file balances, so nobody else should
+	// be able to rewrite them. Only fatal with StrictPerms.
+	for _, name := range append([]string{dataDir, s.cfg.DBFile, s.cfg.LogDir}, logFiles...) {
+		err := checkNotWorldWritable(name)
+		if err != nil && !s.cfg.StrictPerms {
+			logWarn("%v; fix with chmod o-w, or set BUDGET_STRICT_PERMS=true to refuse to start", err)
+			continue
+		}
+		checks = append(checks, check{name + " is not world-writable", err})
+	}
 
-	// Return the new Balance (to keep consistent with other endpoints returning the int)
-	// Or return JSON? The client will likely want both.
-	// For now, let's return JSON here as this is a new endpoint.
-	resp := GetResponse{
-		Balance: s.balance,
-		Budget:  s.budget,
+	if s.cfg.RatesFile != "" {
+		_, err := loadRates(s.cfg.RatesFile)
+		checks = append(checks, check{"exchange rates file " + s.cfg.RatesFile + " is valid", err})
 	}
+
+	if _, err := os.Stat(certFile); err == nil {
+		_, err := tls.LoadX509KeyPair(certFile, keyFile)
+		checks = append(checks, check{"TLS certificate " + certFile + " and key " + keyFile + " are valid", err})
+	}
+
+	ok := true
+	for _, c := range checks {
+		if c.err != nil {
+			logError("Self-check FAILED: %s: %v", c.what, c.err)
+			ok = false
+			continue
+		}
+		logInfo("Self-check ok: %s", c.what)
+	}
+	return ok
+}
+
+// checkWritableDir verifies that a file can be created in dir.
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".selfcheck-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkNotWorldWritable returns an error if the named file or directory
+// exists and anyone may write to it.
+func checkNotWorldWritable(name string) error {
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm&0002 != 0 {
+		return fmt.Errorf("%s is world-writable (mode %04o)", name, perm)
+	}
+	return nil
+}
+
+// checkAppendable verifies that the named file can be opened for appending,
+// creating it with mode if needed.
+func checkAppendable(name string, mode os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkDataFile verifies that the data file, if present, can be parsed,
+// without changing any state. Users must be loaded for legacy files.
+func (s *Server) checkDataFile() error {
+	data, err := os.ReadFile(s.cfg.DBFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	owner := ""
+	if len(s.userOrder) > 0 {
+		owner = s.userOrder[0]
+	}
+	_, _, err = parseData(data, owner)
+	return err
+}
+
+// normalizeOrigin lowercases an origin and removes surrounding space and any
+// trailing slash, so that configured and requested origins compare equal.
+func normalizeOrigin(o string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(o)), "/")
+}
+
+// parsePrefix parses an IP address or CIDR range, e.g. "10.0.0.1" or
+// "10.0.0.0/8". A single address is treated as a range of one.
+func parsePrefix(v string) (netip.Prefix, error) {
+	if strings.Contains(v, "/") {
+		p, err := netip.ParsePrefix(v)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// newHTTPServer returns a server for addr using the default mux, with the
+// configured timeouts so that slow or idle clients cannot hold connections
+// open indefinitely.
+func newHTTPServer(cfg Config, addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: cfg.HeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// tlsVersions maps the accepted BUDGET_TLS_MIN_VERSION values to their
+// crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig returns the HTTPS server's TLS configuration: certificates
+// from certs, HTTP/2 preferred, and no protocol older than TLSMinVersion.
+// Go's default cipher suites are used; they exclude the known-weak ones.
+func newTLSConfig(cfg Config, certs *certReloader) *tls.Config {
+	return &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     cfg.TLSMinVersion,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// certReloader holds the HTTPS certificate in memory so that a renewed
+// cert.pem/key.pem can be swapped in on SIGHUP without a restart.
+type certReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads the certificate pair for the first time.
+func newCertReloader() (*certReloader, error) {
+	cr := &certReloader{}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload reads the certificate pair from disk and replaces the served one.
+// On failure the previous certificate is kept.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// reloadLogged reloads the certificate, logging the outcome. On failure the
+// old certificate stays in use.
+func (cr *certReloader) reloadLogged() {
+	if err := cr.reload(); err != nil {
+		logError("Failed to reload TLS certificate, keeping the previous one: %v", err)
+		return
+	}
+	logInfo("TLS certificate reloaded from %s", certFile)
+}
+
+// reloadOnSIGHUP calls each of the reload functions every time the process
+// receives SIGHUP, until ctx is cancelled.
+func reloadOnSIGHUP(ctx context.Context, reloads ...func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			for _, reload := range reloads {
+				reload()
+			}
+		}
+	}
+}
+
+// maintenanceOnSignal toggles maintenance mode every time the process
+// receives SIGUSR1 (see notifyMaintenance), until ctx is cancelled.
+func (s *Server) maintenanceOnSignal(ctx context.Context) {
+	usr1 := make(chan os.Signal, 1)
+	notifyMaintenance(usr1)
+	defer signal.Stop(usr1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr1:
+			s.mu.Lock()
+			on := !s.maintenance
+			s.mu.Unlock()
+			s.setMaintenance(on, "SIGUSR1")
+		}
+	}
+}
+
+// plainUser is a plaintext users file entry, kept with the SHA-256 of its
+// token for authenticate to compare in constant time.
+type plainUser struct {
+	name   string // The token, which is also the user ID
+	digest [32]byte
+}
+
+// hashedUser is a users file entry storing a salted hash of the token
+// rather than the token itself (see parseHashedLine).
+type hashedUser struct {
+	name string // User ID used for accounts and logs
+	iter int
+	salt []byte
+	hash []byte
+}
+
+// ctxKey is the type of the request context keys set by authMiddleware.
+type ctxKey int
+
+const (
+	ctxUserKey ctxKey = iota // Authenticated user ID (string)
+	ctxRoleKey               // Role of the authenticated user (roleReadOnly, roleReadWrite or roleAdmin)
+	ctxIDKey                 // ID of the request, echoed in X-Request-ID (string)
+)
+
+// tokenBucket tracks the remaining request allowance of one user, or the
+// hashed token checks left to one address. It refills continuously at
+// RateLimit (or HashLimit) tokens per minute up to that many.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// authFailures tracks the failed logins from one address: count of them
+// since first, and until when the address is locked out, if it is.
+type authFailures struct {
+	count int
+	first time.Time
+	until time.Time
+}
+
+// idempotencyKey identifies a client-chosen Idempotency-Key of one user.
+type idempotencyKey struct {
+	user string
+	key  string
+}
+
+// idempotentResult is the response to the first request sent with an
+// Idempotency-Key, replayed for repeats until it expires. done is false
+// while that first request is still being handled; the entry still expires
+// so that a request that never completed doesn't block its key forever.
+type idempotentResult struct {
+	path    string
+	done    bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// pendingSpend is a large spend awaiting confirmation, keyed in
+// Server.pending by the token handed to the client. The token only confirms
+// the same spend, by the same user, before expires.
+type pendingSpend struct {
+	user     string
+	account  string
+	amount   int32
+	category string
+	expires  time.Time
+}
+
+// undoEntry records the change one action made to an account so /undo can
+// apply the inverse.
+type undoEntry struct {
+	balanceDelta int32
+	budgetDelta  int32
+	refunds      int64 // Seq of the transaction the action refunded, 0 if it wasn't a /refund
+}
+
+// undoKey identifies the account an undo stack belongs to.
+type undoKey struct {
+	user    string
+	account string
+}
+
+// Server holds the application state.
+// It uses a mutex to protect the per-user accounts.
+//
+// Fields:
+// - cfg: Runtime configuration (read-only after startup).
+// - mu: RWMutex for thread-safe access to accounts; readers share the read lock.
+// - accounts: Balance and budget keyed by user ID, then by account name.
+// - usersMu: RWMutex protecting users, plainUsers, roles, hashedUsers, userOrder and displayNames, which a reload replaces.
+// - users: Set of authorized plaintext tokens (deprecated; each is also the user ID).
+// - plainUsers: The same tokens with their digests, as authenticate checks them.
+// - roles: Role of each user ID (roleReadOnly, roleReadWrite or roleAdmin).
+// - hashedUsers: Authorized users whose tokens are stored as salted hashes.
+// - userOrder: User IDs in the order they appear in the users file.
+// - displayNames: Display names from a JSON users file, keyed by user ID.
+// - authMu: Mutex protecting authCache.
+// - authCache: User ID keyed by SHA-256 of an already verified hashed token.
+// - recurring: Recurring transaction rules of all users (persisted with the accounts).
+// - baselines: Named account snapshots saved by /baseline (persisted with the accounts).
+// - seq: Last transaction sequence number issued (persisted with the accounts).
+// - dirty: State has changed since it was last saved, e.g. seq or after a failed save.
+// - modified: When the state was last changed, reported by /get as Last-Modified.
+// - maintenance: Writes are refused with 503 (see setMaintenance); not persisted.
+// - categories: Allowed spend categories (persisted with the accounts once changed via /categories).
+// - undo: Recent undoable actions per user and account, newest last (capped at maxUndoDepth).
+// - rateMu: Mutex protecting buckets, lastSweep, hashBuckets and hashSweep (kept separate from mu).
+// - pendingMu: Mutex protecting pending and pendingSweep.
+// - pending: Large spends awaiting confirmation, keyed by confirmation token.
+// - pendingSweep: When expired pending spends were last dropped.
+// - ratesMu: RWMutex protecting rates.
+// - rates: Exchange rates keyed by "FROM/TO", loaded from Config.RatesFile.
+// - buckets: Per-user token buckets used by the rate limiter.
+// - lastSweep: When idle buckets were last dropped.
+// - hashBuckets: Per-address token buckets limiting hashed token checks (see allowHashing).
+// - hashSweep: When idle hashBuckets were last dropped.
+// - lockoutMu: Mutex protecting failures and failSweep.
+// - failures: Failed logins and lockouts keyed by client address (see lockedOut).
+// - failSweep: When expired failures were last dropped.
+// - eventsMu: Mutex protecting subscribers.
+// - subscribers: Connected /events clients.
+// - closing: Closed at shutdown to end the /events streams.
+// - idemMu: Mutex protecting idemResults and idemSweep.
+// - idemResults: Responses to requests sent with an Idempotency-Key, replayed for repeats until Config.IdempotencyTTL.
+// - idemSweep: When expired idemResults were last dropped.
+// - transLogger: Logger for financial transactions.
+// - unauthLogger: Logger for unauthorized access attempts.
+// - accessLogger: Logger for successful reads, nil unless Config.AccessLog is set.
+// - metrics: Request counters exposed on /metrics.
+// - stats: Lifetime counters reported by /stats, saved with the accounts.
+// - lockWaits: How long handlers have waited for mu, reported by /stats.
+// - txIndex: Recently logged transactions, served to the reporting endpoints.
+// - started: When the process started, reported by /ping.
+// - loc: Time zone of logged dates and times and of budget cycles (Config.TimeZone).
+type Server struct {
+	cfg          Config
+	mu           sync.RWMutex
+	accounts     map[string]map[string]*Account
+	recurring    []*RecurringRule
+	baselines    []*Baseline
+	seq          int64
+	dirty        bool
+	modified     time.Time
+	maintenance  bool
+	categories   map[string]bool
+	usersMu      sync.RWMutex
+	users        map[string]bool
+	plainUsers   []plainUser
+	roles        map[string]string
+	hashedUsers  []hashedUser
+	userOrder    []string
+	displayNames map[string]string
+	authMu       sync.Mutex
+	authCache    map[[32]byte]string
+	undo         map[undoKey][]undoEntry
+	rateMu       sync.Mutex
+	buckets      map[string]*tokenBucket
+	lastSweep    time.Time
+	hashBuckets  map[string]*tokenBucket
+	hashSweep    time.Time
+	lockoutMu    sync.Mutex
+	failures     map[string]*authFailures
+	failSweep    time.Time
+	eventsMu     sync.Mutex
+	subscribers  map[*subscriber]struct{}
+	closing      chan struct{}
+	idemMu       sync.Mutex
+	idemResults  map[idempotencyKey]*idempotentResult
+	idemSweep    time.Time
+	pendingMu    sync.Mutex
+	pending      map[string]*pendingSpend
+	pendingSweep time.Time
+	ratesMu      sync.RWMutex
+	rates        map[string]*big.Rat
+	transLogger  *ThreadSafeLogger
+	unauthLogger *ThreadSafeLogger
+	accessLogger *ThreadSafeLogger
+	metrics      serverMetrics
+	stats        lifetimeStats
+	lockWaits    lockWaits
+	txIndex      *transactionIndex
+	started      time.Time
+	loc          *time.Location
+}
+
+// newServer returns a Server for cfg with empty state, started at the given
+// time. Loggers, users and data are set up by the caller.
+func newServer(cfg Config, started time.Time) *Server {
+	return &Server{
+		cfg:         cfg,
+		started:     started,
+		accounts:    make(map[string]map[string]*Account),
+		users:       make(map[string]bool),
+		roles:       make(map[string]string),
+		authCache:   make(map[[32]byte]string),
+		categories:  maps.Clone(cfg.Categories),
+		undo:        make(map[undoKey][]undoEntry),
+		buckets:     make(map[string]*tokenBucket),
+		hashBuckets: make(map[string]*tokenBucket),
+		failures:    make(map[string]*authFailures),
+		subscribers: make(map[*subscriber]struct{}),
+		closing:     make(chan struct{}),
+		idemResults: make(map[idempotencyKey]*idempotentResult),
+		modified:    started,
+		pending:     make(map[string]*pendingSpend),
+		txIndex:     newTransactionIndex(cfg.TxCacheSize),
+		loc:         loadLocation(cfg.TimeZone),
+	}
+}
+
+// lifetimeStats holds the live counterpart of Stats. The counters are atomic
+// as unauthorized requests are counted without taking s.mu; unsaved is set
+// by every change so that flush persists the counters even when nothing
+// else changed.
+type lifetimeStats struct {
+	spends        atomic.Int64
+	spent         atomic.Int64
+	sets          atomic.Int64
+	budgetChanges atomic.Int64
+	unauthorized  atomic.Int64
+	unsaved       atomic.Bool
+}
+
+// add increments counter by n and marks the counters unsaved.
+func (st *lifetimeStats) add(counter *atomic.Int64, n int64) {
+	counter.Add(n)
+	st.unsaved.Store(true)
+}
+
+// snapshot returns the current values of the counters.
+func (st *lifetimeStats) snapshot() Stats {
+	return Stats{
+		Spends:        st.spends.Load(),
+		SpentTotal:    st.spent.Load(),
+		Sets:          st.sets.Load(),
+		BudgetChanges: st.budgetChanges.Load(),
+		Unauthorized:  st.unauthorized.Load(),
+	}
+}
+
+// load sets the counters to the values persisted in the data file.
+func (st *lifetimeStats) load(saved Stats) {
+	st.spends.Store(saved.Spends)
+	st.spent.Store(saved.SpentTotal)
+	st.sets.Store(saved.Sets)
+	st.budgetChanges.Store(saved.BudgetChanges)
+	st.unauthorized.Store(saved.Unauthorized)
+}
+
+// serverMetrics holds the lifetime counters exposed on /metrics.
+// They are atomic so handlers can update them without taking s.mu.
+type serverMetrics struct {
+	spends       atomic.Int64
+	credits      atomic.Int64
+	sets         atomic.Int64
+	unauthorized atomic.Int64
+}
+
+// lockWaits accumulates how long handlers waited to acquire s.mu, so
+// contention shows up on /stats before it shows up as slow requests.
+// Durations are in nanoseconds.
+type lockWaits struct {
+	acquired atomic.Int64
+	slow     atomic.Int64
+	total    atomic.Int64
+	max      atomic.Int64
+}
+
+// LockStats is the lock-wait section of the /stats response. Slow counts
+// the acquisitions that waited longer than Config.LockWarn.
+type LockStats struct {
+	Acquired    int64   `json:"acquired"`
+	Slow        int64   `json:"slow"`
+	TotalWaitMs float64 `json:"total_wait_ms"`
+	MaxWaitMs   float64 `json:"max_wait_ms"`
+	WarnMs      float64 `json:"warn_ms"`
+}
+
+// StatsResponse is the body of /stats: the persisted lifetime counters
+// plus the lock-wait counters of this process.
+type StatsResponse struct {
+	Stats
+	Lock LockStats `json:"lock"`
+}
+
+// lock takes the state write lock on behalf of r. It should be used
+// instead of s.mu.Lock in handlers so that slow acquisitions are noticed.
+func (s *Server) lock(r *http.Request) {
+	start := time.Now()
+	s.mu.Lock()
+	s.lockAcquired(r, "write", time.Since(start))
+}
+
+// rlock is the read-lock counterpart of lock.
+func (s *Server) rlock(r *http.Request) {
+	start := time.Now()
+	s.mu.RLock()
+	s.lockAcquired(r, "read", time.Since(start))
+}
+
+// lockAcquired records that r waited wait for s.mu and logs a warning
+// naming the endpoint if that took longer than Config.LockWarn.
+func (s *Server) lockAcquired(r *http.Request, kind string, wait time.Duration) {
+	lw := &s.lockWaits
+	lw.acquired.Add(1)
+	lw.total.Add(int64(wait))
+	for {
+		prev := lw.max.Load()
+		if int64(wait) <= prev || lw.max.CompareAndSwap(prev, int64(wait)) {
+			break
+		}
+	}
+	if s.cfg.LockWarn > 0 && wait > s.cfg.LockWarn {
+		lw.slow.Add(1)
+		logAt("warn", requestID(r), "%s %s waited %s for the state %s lock",
+			r.Method, r.URL.Path, wait.Round(time.Millisecond), kind)
+	}
+}
+
+// lockStats returns the lock-wait counters for /stats.
+func (s *Server) lockStats() LockStats {
+	ms := func(ns int64) float64 { return float64(ns) / float64(time.Millisecond) }
+	lw := &s.lockWaits
+	return LockStats{
+		Acquired:    lw.acquired.Load(),
+		Slow:        lw.slow.Load(),
+		TotalWaitMs: ms(lw.total.Load()),
+		MaxWaitMs:   ms(lw.max.Load()),
+		WarnMs:      ms(int64(s.cfg.LockWarn)),
+	}
+}
+
+// moneyScale is the number of decimal places Money accepts, i.e.
+// Config.MinorUnits. It is set once at startup, before the server starts.
+var moneyScale int32 = 2
+
+// Money is an amount in minor units in a request body. It can be sent as a
+// JSON integer of minor units, as clients always have, or as a decimal
+// string in major units such as "12.34" or "-0.5", which is converted
+// exactly using moneyScale. A string with more decimal places than the
+// currency has is rejected with a moneyError rather than rounded.
+type Money int32
+
+// moneyError reports a decimal Money string that could not be converted.
+type moneyError struct {
+	value  string
+	reason string
+}
+
+func (e *moneyError) Error() string {
+	return fmt.Sprintf("Invalid amount %q: %s", e.value, e.reason)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	if len(b) == 0 || b[0] != '"' {
+		var minor int32
+		if err := json.Unmarshal(b, &minor); err != nil {
+			return err
+		}
+		*m = Money(minor)
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	minor, err := parseMoney(str, moneyScale)
+	if err != nil {
+		return err
+	}
+	*m = Money(minor)
+	return nil
+}
+
+// parseMoney converts a decimal string in major units, with an optional
+// leading '-' and at most scale decimal places, to minor units.
+func parseMoney(str string, scale int32) (int32, error) {
+	digits, neg := strings.CutPrefix(str, "-")
+	whole, frac, hasPoint := strings.Cut(digits, ".")
+	if whole == "" || (hasPoint && frac == "") {
+		return 0, &moneyError{str, "expected a decimal number such as 12.34"}
+	}
+	for _, part := range []string{whole, frac} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, &moneyError{str, "expected a decimal number such as 12.34"}
+			}
+		}
+	}
+	if len(frac) > int(scale) {
+		return 0, &moneyError{str, fmt.Sprintf("at most %d decimal places allowed", scale)}
+	}
+
+	// Pad the fraction to whole minor units, then drop leading zeros so
+	// long but small values such as "0000000000.01" still fit
+	minor := strings.TrimLeft(whole+frac+strings.Repeat("0", int(scale)-len(frac)), "0")
+	if minor == "" {
+		return 0, nil
+	}
+	if neg {
+		minor = "-" + minor
+	}
+	v, err := strconv.ParseInt(minor, 10, 32)
+	if err != nil {
+		return 0, &moneyError{str, "out of range"}
+	}
+	return int32(v), nil
+}
+
+// SetRequest defines the JSON payload for setting the absolute balance.
+type SetRequest struct {
+	Amount Money `json:"amount"`
+}
+
+// SpendRequest defines the JSON payload for spending (reducing) the balance.
+// Category is optional and must be one of the configured categories. Memo
+// is optional free text, see cleanMemo.
+// Amount is positive unless Config.SpendSign is spendSignInflow, in which
+// case it is the (negative) change to the balance; see spendAmount.
+type SpendRequest struct {
+	Amount   Money  `json:"amount"`
+	Category string `json:"category,omitempty"`
+	Memo     string `json:"memo,omitempty"`
+}
+
+// BatchItemStatus reports what happened to one item of a /spend/batch
+// request. Error and Message are only set for invalid items.
+type BatchItemStatus struct {
+	Status  string `json:"status"` // One of the batchItem constants
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Values of BatchItemStatus.Status.
+const (
+	batchItemApplied = "applied" // The batch succeeded and the item was logged
+	batchItemValid   = "valid"   // The item was fine but another one failed, so nothing was applied
+	batchItemInvalid = "invalid" // The item failed validation
+)
+
+// SpendBatchResponse defines the JSON response of a successful /spend/batch:
+// the account as returned by /get and the status of each item, in order.
+type SpendBatchResponse struct {
+	GetResponse
+	Items []BatchItemStatus `json:"items"`
+}
+
+// SpendBatchError defines the 400 response to a rejected /spend/batch. Error
+// and Message describe the first invalid item.
+type SpendBatchError struct {
+	ErrorResponse
+	Items []BatchItemStatus `json:"items"`
+}
+
+// RecurringRequest defines the JSON payload for creating a recurring rule.
+type RecurringRequest struct {
+	Amount      Money  `json:"amount"`
+	Category    string `json:"category"`
+	Day         int    `json:"day"`
+	Description string `json:"description"`
+}
+
+// CreditRequest defines the JSON payload for crediting (increasing) the balance.
+type CreditRequest struct {
+	Amount Money `json:"amount"`
+}
+
+// AdjustRequest defines the JSON payload for changing the balance by a signed delta.
+type AdjustRequest struct {
+	Delta Money `json:"delta"`
+}
+
+// RefundRequest defines the JSON payload for reversing a logged transaction,
+// identified by its sequence number.
+type RefundRequest struct {
+	Seq int64 `json:"seq"`
+}
+
+// SetBudgetRequest defines the JSON payload for setting the budget.
+type SetBudgetRequest struct {
+	Budget   Money `json:"budget"`
+	Rollover bool  `json:"rollover,omitempty"` // Start a new period, adding the remaining balance to Budget
+}
+
+// InitRequest defines the JSON payload for setting the balance and the
+// budget in one go.
+type InitRequest struct {
+	Balance Money `json:"balance"`
+	Budget  Money `json:"budget"`
+}
+
+// GetResponse defines the JSON response for the get endpoint.
+// Amounts are in minor units of Currency. Version can be sent back in an
+// If-Match header to make a write conditional (see checkIfMatch).
+// Spent is the total of the account's logged spends in the current budget
+// cycle (see cycleWindow) that were not refunded, so credits and
+// adjustments don't distort it; Remaining repeats Balance. Mode is
+// balanceModeStrict or, when negative budgets are allowed, balanceModeDebt.
+type GetResponse struct {
+	Balance   int32  `json:"balance"`
+	Budget    int32  `json:"budget"`
+	Currency  string `json:"currency"`
+	Version   int64  `json:"version"`
+	Spent     int64  `json:"spent"`
+	Remaining int32  `json:"remaining"`
+	Seq       int64  `json:"seq"`        // Last transaction sequence number issued, by any user
+	SpendSign string `json:"spend_sign"` // Sign convention of /spend amounts, see Config.SpendSign
+	Mode      string `json:"balance_mode"`
+}
+
+// SetBudgetResponse defines the JSON response for the set_budget endpoint:
+// the account as returned by /get, the mode that was applied, the part of
+// the new budget already used (budget - balance) and, for a rollover, the
+// balance carried over into the budget.
+type SetBudgetResponse struct {
+	GetResponse
+	Mode       string `json:"mode"`
+	BudgetUsed int64  `json:"budget_used"`
+	RolledOver int32  `json:"rolled_over,omitempty"`
+}
+
+// WhoamiResponse defines the JSON response for the whoami endpoint.
+// Balance and Budget are those of the default account.
+type WhoamiResponse struct {
+	User     string   `json:"user"`
+	Name     string   `json:"display_name,omitempty"` // Set in a JSON users file
+	Balance  int32    `json:"balance"`
+	Budget   int32    `json:"budget"`
+	Currency string   `json:"currency"`
+	Accounts []string `json:"accounts"` // Names of the user's accounts, sorted
+	Role     string   `json:"role"`     // "ro", "rw" or "admin"
+}
+
+// UserInfo describes one configured user in the /admin/users response.
+// For plaintext entries the user ID is the token itself, so it is masked.
+type UserInfo struct {
+	ID     string `json:"id"`
+	Role   string `json:"role"`
+	Hashed bool   `json:"hashed"`
+	Name   string `json:"display_name,omitempty"`
+}
+
+// Transaction is a single parsed row of the transaction CSV log.
+type Transaction struct {
+	Date     string `json:"date"`
+	Time     string `json:"time"`
+	User     string `json:"user"`
+	Action   string `json:"action"`
+	Amount   int32  `json:"amount"`
+	Category string `json:"category,omitempty"`
+	Account  string `json:"account,omitempty"`
+	Seq      int64  `json:"seq,omitempty"` // Absent from records logged before sequence numbers existed
+	Memo     string `json:"memo,omitempty"`
+}
+
+// accountName returns the account t was logged against. Records from before
+// named accounts have no account column and belong to the default one.
+func (t Transaction) accountName() string {
+	if t.Account == "" {
+		return defaultAccountName
+	}
+	return t.Account
+}
+
+// ownedBy reports whether t was logged against user's account name.
+func (t Transaction) ownedBy(user, name string) bool {
+	return t.User == user && t.accountName() == name
+}
+
+// version identifies the build, reported by /ping. Set it at build time with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// Errors returned by lockDataFile.
+var (
+	errDataLocked      = errors.New("data file is locked by another process")
+	errLockUnsupported = errors.New("file locking is not supported on this platform")
+)
+
+func main() {
+	started := time.Now()
+	hashUser := flag.String("hash-user", "", "print a hashed users file line for `NAME` (token read from stdin) and exit")
+	migrateUsers := flag.String("migrate-users", "", "print the line-based users `FILE` converted to the JSON format and exit")
+	flag.Parse()
+	if *hashUser != "" {
+		printHashedLine(*hashUser)
+		return
+	}
+	if *migrateUsers != "" {
+		printMigratedUsers(*migrateUsers)
+		return
+	}
+
+	// Chosen before the rest of the configuration so that its warnings
+	// already use the requested format
+	setLogFormat(envString("BUDGET_LOG_FORMAT", "text"))
+	cfg := loadConfig()
+	logInfo("Budget tracker version %s", version)
+	cfg.logConfig()
+	moneyScale = cfg.MinorUnits
+
+	if err := createDirs(cfg); err != nil {
+		logFatal("Failed to prepare directories: %v. Create it with write access for this user, or point BUDGET_DATA_DIR/BUDGET_LOG_DIR elsewhere.", err)
+	}
+
+	// Refuse to run alongside another instance using the same data file, as
+	// their saves would interleave
+	lockFile := cfg.DBFile + lockSuffix
+	unlock, err := lockDataFile(lockFile)
+	switch {
+	case errors.Is(err, errDataLocked):
+		logFatal("%s is locked: another instance is using %s. Stop it first.", lockFile, cfg.DBFile)
+	case errors.Is(err, errLockUnsupported):
+		logWarn("Not locking %s: %v", cfg.DBFile, err)
+		unlock = func() {}
+	case err != nil:
+		logFatal("Failed to lock %s: %v", lockFile, err)
+	}
+
+	// Initialize Server state
+	srv := newServer(cfg, started)
+
+	// Verify the environment before anything is written; this also loads
+	// the users whitelist
+	if !srv.selfCheck() {
+		logFatal("Self-check failed, refusing to start. Fix the problems above and restart.")
+	}
+
+	// Initialize Loggers (thread-safe for concurrent access)
+	tl, err := NewRotatingLogger(cfg.TransLogFile, cfg.FileMode, cfg.LogMaxBytes, cfg.LogKeep)
+	if err != nil {
+		logFatal("Failed to open transaction log: %v", err)
+	}
+
+	ul, err := NewRotatingLogger(cfg.UnauthLogFile, cfg.FileMode, cfg.LogMaxBytes, cfg.LogKeep)
+	if err != nil {
+		logFatal("Failed to open unauthorized log: %v", err)
+	}
+	srv.transLogger, srv.unauthLogger = tl, ul
+
+	if cfg.AccessLog {
+		al, err := NewRotatingLogger(cfg.AccessLogFile, cfg.FileMode, cfg.LogMaxBytes, cfg.LogKeep)
+		if err != nil {
+			logFatal("Failed to open access log: %v", err)
+		}
+		srv.accessLogger = al
+	}
+
+	srv.reloadRates()
+
+	// Parse the transaction log once; later entries are added as they are logged
+	if err := srv.txIndex.load(cfg.TransLogFile); err != nil {
+		logWarn("Failed to index transaction log, reports will read the file: %v", err)
+	}
+
+	// Keep a copy of the data file as found, before loadData can migrate
+	// (rewrite) it
+	if err := srv.backupData(); err != nil {
+		logError("Error backing up data: %v", err)
+	}
+
+	// Load existing accounts from disk (users must be loaded first for migration)
+	dataLoaded := true
+	if err := srv.loadData(); err != nil {
+		logWarn("Failed to load data (starting at 0): %v", err)
+		dataLoaded = false
+	}
+
+	// Transactions are logged after the save that records them, so after a
+	// crash the log may hold sequence numbers the data file doesn't; carry
+	// on from the highest so none is issued twice
+	if last, err := srv.recentTransactions(1); err == nil && len(last) == 1 {
+		srv.seq = max(srv.seq, last[0].Seq)
+	}
+
+	// Route Handlers with Auth Middleware
+	http.HandleFunc("/get", srv.authMiddleware(srv.handleGet))
+	http.HandleFunc("/whoami", srv.authMiddleware(srv.handleWhoami))
+	http.HandleFunc("/events", srv.authMiddleware(srv.handleEvents))
+	http.HandleFunc("/accounts", srv.authMiddleware(srv.gzipped(srv.handleAccounts)))
+	http.HandleFunc("/set", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleSet))))
+	http.HandleFunc("/spend", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleSpend))))
+	http.HandleFunc("/spend/batch", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleSpendBatch))))
+	http.HandleFunc("/credit", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleCredit))))
+	http.HandleFunc("/adjust", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleAdjust))))
+	http.HandleFunc("/refund", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleRefund))))
+	http.HandleFunc("/set_budget", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleSetBudget))))
+	http.HandleFunc("/history", srv.authMiddleware(srv.gzipped(srv.handleHistory)))
+	http.HandleFunc("/audit/unauthorized", srv.authMiddleware(srv.gzipped(srv.handleUnauthorizedLog)))
+	http.HandleFunc("/admin/users", srv.authMiddleware(srv.adminOnly(srv.handleUsers)))
+	http.HandleFunc("/admin/backup", srv.authMiddleware(srv.adminOnly(srv.handleBackup)))
+	http.HandleFunc("/admin/restore", srv.authMiddleware(srv.adminOnly(srv.handleRestore)))
+	http.HandleFunc("/admin/maintenance", srv.authMiddleware(srv.adminOnly(srv.handleMaintenance)))
+	http.HandleFunc("/undo", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleUndo))))
+	http.HandleFunc("/reset", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleReset))))
+	http.HandleFunc("/init", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleInit))))
+	http.HandleFunc("/category_budget", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleCategoryBudget))))
+	http.HandleFunc("/recurring", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleRecurring))))
+	http.HandleFunc("/categories", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleCategories))))
+	http.HandleFunc("/baseline", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleBaseline))))
+	http.HandleFunc("/diff", srv.authMiddleware(srv.gzipped(srv.handleDiff)))
+	http.HandleFunc("/transactions/export", srv.authMiddleware(srv.gzipped(srv.handleExport)))
+	http.HandleFunc("/transactions/search", srv.authMiddleware(srv.gzipped(srv.handleSearch)))
+	http.HandleFunc("/summary", srv.authMiddleware(srv.gzipped(srv.handleSummary)))
+	http.HandleFunc("/summary/projection", srv.authMiddleware(srv.handleProjection))
+	http.HandleFunc("/summary/category", srv.authMiddleware(srv.handleByCategory))
+	http.HandleFunc("/budget/progress", srv.authMiddleware(srv.handleProgress))
+	http.HandleFunc("/stats", srv.authMiddleware(srv.handleStats))
+	http.HandleFunc("/convert", srv.authMiddleware(srv.handleConvert))
+	http.HandleFunc("/format", srv.authMiddleware(srv.handleFormat))
+	http.HandleFunc("/currency", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleSetCurrency))))
+	http.HandleFunc("/import", srv.authMiddleware(srv.writable(srv.idempotent(srv.handleImport))))
+
+	// Named accounts; the unscoped routes above act on the default account
+	http.HandleFunc("/accounts/{name}/get", srv.authMiddleware(accountScoped(srv.handleGet)))
+	http.HandleFunc("/accounts/{name}/events", srv.authMiddleware(accountScoped(srv.handleEvents)))
+	http.HandleFunc("/accounts/{name}/set", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleSet)))))
+	http.HandleFunc("/accounts/{name}/spend", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleSpend)))))
+	http.HandleFunc("/accounts/{name}/spend/batch", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleSpendBatch)))))
+	http.HandleFunc("/accounts/{name}/credit", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleCredit)))))
+	http.HandleFunc("/accounts/{name}/adjust", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleAdjust)))))
+	http.HandleFunc("/accounts/{name}/refund", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleRefund)))))
+	http.HandleFunc("/accounts/{name}/set_budget", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleSetBudget)))))
+	http.HandleFunc("/accounts/{name}/undo", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleUndo)))))
+	http.HandleFunc("/accounts/{name}/reset", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleReset)))))
+	http.HandleFunc("/accounts/{name}/init", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleInit)))))
+	http.HandleFunc("/accounts/{name}/category_budget", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleCategoryBudget)))))
+	http.HandleFunc("/accounts/{name}/convert", srv.authMiddleware(accountScoped(srv.handleConvert)))
+	http.HandleFunc("/accounts/{name}/currency", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleSetCurrency)))))
+	http.HandleFunc("/accounts/{name}/baseline", srv.authMiddleware(srv.writable(srv.idempotent(accountScoped(srv.handleBaseline)))))
+	http.HandleFunc("/accounts/{name}/diff", srv.authMiddleware(srv.gzipped(accountScoped(srv.handleDiff))))
+	http.HandleFunc("/accounts/{name}/history", srv.authMiddleware(srv.gzipped(accountScoped(srv.handleHistory))))
+	http.HandleFunc("/accounts/{name}/transactions/export", srv.authMiddleware(srv.gzipped(accountScoped(srv.handleExport))))
+	http.HandleFunc("/accounts/{name}/transactions/search", srv.authMiddleware(srv.gzipped(accountScoped(srv.handleSearch))))
+	http.HandleFunc("/accounts/{name}/summary/projection", srv.authMiddleware(accountScoped(srv.handleProjection)))
+
+	// Unauthenticated liveness probe for load balancers and systemd
+	http.HandleFunc("/healthz", srv.handleHealthz)
+	http.HandleFunc("/ping", srv.handlePing)
+	http.HandleFunc("/openapi.json", srv.handleOpenAPI)
+
+	// The web app. "/" only matches paths that no route above does, so the
+	// files cannot shadow the API.
+	if cfg.ServeApp {
+		http.Handle("/", appHandler(appFiles(cfg)))
+	}
+
+	// Prometheus scrape endpoint, optionally behind auth
+	if cfg.MetricsAuth {
+		http.HandleFunc("/metrics", srv.authMiddleware(srv.handleMetrics))
+	} else {
+		http.HandleFunc("/metrics", srv.handleMetrics)
+	}
+
+	// Stop on SIGINT (Ctrl+C) or SIGTERM (systemd stop/restart)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The HTTP and HTTPS servers run as peers in their own goroutines. A server
+	// that fails reports it here instead of exiting, so the other one is still
+	// shut down gracefully and the state saved.
+	serverErrs := make(chan error, 2)
+
+	httpServer := newHTTPServer(cfg, cfg.HTTPAddr)
+	go func() {
+		logInfo("HTTP Server listening on %s", cfg.HTTPAddr)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErrs <- fmt.Errorf("HTTP Server failed: %w", err)
+		}
+	}()
+
+	// Files reread on SIGHUP, e.g. after editing the rates or renewing the certificate
+	reloads := []func(){srv.reloadUsers, srv.reloadRates}
+
+	// Check for SSL certificates to optionally start HTTPS server
+	// This enables PWA installation on mobile devices.
+	var httpsServer *http.Server
+	if _, err := os.Stat(certFile); err == nil {
+		certs, err := newCertReloader()
+		if err != nil {
+			logFatal("Failed to load TLS certificate: %v", err)
+		}
+		reloads = append(reloads, certs.reloadLogged)
+
+		tlsConfig := newTLSConfig(cfg, certs)
+		httpsServer = newHTTPServer(cfg, cfg.HTTPSAddr)
+		httpsServer.TLSConfig = tlsConfig
+		go func() {
+			logInfo("HTTPS Server listening on %s (minimum %s, HTTP/2 enabled)", cfg.HTTPSAddr, tls.VersionName(tlsConfig.MinVersion))
+			// The certificate comes from TLSConfig.GetCertificate
+			if err := httpsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				serverErrs <- fmt.Errorf("HTTPS Server failed: %w", err)
+			}
+		}()
+	} else {
+		logInfo("No cert.pem/key.pem found. HTTPS disabled. Running in HTTP-only mode.")
+	}
+
+	// Apply recurring transactions in the background. Skipped if the data
+	// file failed to load, as applying a rule saves (and would overwrite) it.
+	if dataLoaded {
+		go srv.runRecurring(ctx)
+	}
+
+	// Periodic backups. Also skipped after a failed load: the file doesn't
+	// change, and pruning would eventually replace every good backup with
+	// copies of the unreadable one.
+	if dataLoaded && cfg.BackupInterval > 0 {
+		go srv.runBackups(ctx)
+	}
+
+	// Transaction log retention
+	if cfg.RetentionDays > 0 {
+		go srv.runPrune(ctx)
+	}
+
+	// Periodic flush; like the final save, it leaves an unreadable data file alone
+	if cfg.FlushInterval > 0 {
+		go srv.runFlush(ctx, dataLoaded)
+	}
+
+	go reloadOnSIGHUP(ctx, reloads...)
+	go srv.maintenanceOnSignal(ctx)
+
+	// Run until a signal arrives or either server fails
+	failed := false
+	select {
+	case <-ctx.Done():
+	case err := <-serverErrs:
+		logError("%v", err)
+		failed = true
+	}
+	stop()
+
+	logInfo("Shutting down (timeout %s)...", srv.cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), srv.cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting new requests and wait for in-flight handlers to finish,
+	// after ending the /events streams, which would otherwise run until the
+	// timeout
+	close(srv.closing)
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		logError("HTTP Server shutdown: %v", err)
+	}
+	if httpsServer != nil {
+		if err := httpsServer.Shutdown(shutdownCtx); err != nil {
+			logError("HTTPS Server shutdown: %v", err)
+		}
+	}
+
+	// Final save; skipped if the data file failed to load so that an
+	// unreadable file is never overwritten with zeroed state.
+	if dataLoaded {
+		srv.mu.Lock()
+		if err := srv.saveData(); err != nil {
+			logError("Error saving data: %v", err)
+		}
+		srv.mu.Unlock()
+	}
+
+	tl.Close()
+	ul.Close()
+	if srv.accessLogger != nil {
+		srv.accessLogger.Close()
+	}
+	unlock()
+	logInfo("Shutdown complete")
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// printHashedLine reads a token from stdin and prints the users file line
+// for name, so new users can be added without storing plaintext tokens.
+func printHashedLine(name string) {
+	if strings.ContainsAny(name, ":$") {
+		log.Fatalf("User name must not contain ':' or '$'")
+	}
+	fmt.Fprint(os.Stderr, "Token: ")
+	token, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatalf("Failed to read token: %v", err)
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		log.Fatalf("Token must not be empty")
+	}
+	line, err := newHashedLine(name, token)
+	if err != nil {
+		log.Fatalf("Failed to hash token: %v", err)
+	}
+	fmt.Println(line)
+}
+
+// printMigratedUsers prints the users listed in a line-based users file as
+// a JSON users file (see usersFile). Tokens and hashes are carried over as
+// they are, so every user keeps their user ID, role and token.
+func printMigratedUsers(filename string) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		log.Fatalf("Failed to read users file: %v", err)
+	}
+	if info.IsDir() {
+		log.Fatalf("%s is a directory: migrate each file in it separately", filename)
+	}
+	if isJSONUsersFile(filename) {
+		log.Fatalf("%s is already in the JSON format", filename)
+	}
+
+	u := newUserSet(math.MaxInt)
+	if _, err := u.loadFile(filename); err != nil {
+		log.Fatalf("Failed to read users file: %v", err)
+	}
+	if u.skipped > 0 {
+		log.Fatalf("%s has %d malformed line(s); fix or remove them first", filename, u.skipped)
+	}
+
+	hashed := make(map[string]hashedUser)
+	for _, hu := range u.hashed {
+		hashed[hu.name] = hu
+	}
+	var out usersFile
+	for _, id := range u.order {
+		entry := userEntry{Role: u.roles[id]}
+		if hu, ok := hashed[id]; ok {
+			entry.Name, entry.Hash = id, hu.encoded()
+		} else {
+			entry.Token = id
+		}
+		out.Users = append(out.Users, entry)
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode users: %v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// envDuration returns the duration stored in the named environment variable,
+// or def if it is unset or cannot be parsed.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logWarn("invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// envFileMode returns the octal permissions (e.g. 0640) stored in the named
+// environment variable, or def if it is unset, cannot be parsed or would
+// make files world-writable.
+func envFileMode(name string, def os.FileMode) os.FileMode {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || m > 0777 {
+		logWarn("invalid %s %q, using %04o", name, v, def)
+		return def
+	}
+	if m&0002 != 0 {
+		logWarn("%s %q would make files world-writable, using %04o", name, v, def)
+		return def
+	}
+	return os.FileMode(m)
+}
+
+// envString returns the named environment variable, or def if it is unset.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt32 returns the int32 stored in the named environment variable,
+// or def if it is unset or cannot be parsed.
+func envInt32(name string, def int32) int32 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		logWarn("invalid %s %q, using %d", name, v, def)
+		return def
+	}
+	return int32(n)
+}
+
+// envInt64 returns the int64 stored in the named environment variable,
+// or def if it is unset or cannot be parsed.
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		logWarn("invalid %s %q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// envBool returns the boolean stored in the named environment variable,
+// or def if it is unset or cannot be parsed.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logWarn("invalid %s %q, using %t", name, v, def)
+		return def
+	}
+	return b
+}
+
+// loadUsers reads the 'users' whitelist.
+// Each file is either line-based or JSON (see loadFile).
+// The users file may be a single file or a directory, in which case every regular
+// file inside it is read (symlinks, subdirectories and dotfiles are skipped)
+// and the users are merged. In directory mode a file that fails to load is
+// logged and skipped rather than aborting the whole load.
+// The users replace the current ones only once the whole list has been read
+// and is not empty, so a failed reload leaves the previous whitelist in place.
+func (s *Server) loadUsers() error {
+	info, err := os.Stat(s.cfg.UsersFile)
+	if err != nil {
+		return err
+	}
+
+	u := newUserSet(s.cfg.MaxUsers)
+	plaintext := 0
+	if info.IsDir() {
+		entries, err := os.ReadDir(s.cfg.UsersFile)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(s.cfg.UsersFile, e.Name())
+			n, err := u.loadFile(path)
+			plaintext += n
+			if errors.Is(err, errTooManyUsers) {
+				break
+			}
+			if err != nil {
+				logWarn("skipping rest of users file: %v", err)
+			}
+		}
+	} else {
+		n, err := u.loadFile(s.cfg.UsersFile)
+		plaintext = n
+		if err != nil && !errors.Is(err, errTooManyUsers) {
+			return err
+		}
+	}
+	if u.truncated {
+		if !s.cfg.UsersLenient {
+			return fmt.Errorf("%s lists more than %d users; raise BUDGET_MAX_USERS or set BUDGET_USERS_LENIENT", s.cfg.UsersFile, s.cfg.MaxUsers)
+		}
+		logWarn("%s lists more than %d users; only the first %d were loaded", s.cfg.UsersFile, s.cfg.MaxUsers, s.cfg.MaxUsers)
+	}
+	if len(u.order) == 0 {
+		return errors.New("no users listed")
+	}
+	if u.skipped > 0 {
+		logWarn("%s: skipped %d malformed line(s) (longer than %d characters or containing control characters)",
+			s.cfg.UsersFile, u.skipped, maxTokenLen)
+	}
+
+	if plaintext > 0 {
+		logWarn("%s contains %d plaintext token(s). Plaintext tokens are deprecated; "+
+			"replace each line with the output of 'budget -hash-user NAME'.", s.cfg.UsersFile, plaintext)
+	}
+
+	plain := make([]plainUser, 0, len(u.plain))
+	for token := range u.plain {
+		plain = append(plain, plainUser{name: token, digest: sha256.Sum256([]byte(token))})
+	}
+
+	// The auth cache is cleared under the same lock, as it may hold users
+	// that have just been removed
+	s.usersMu.Lock()
+	s.users, s.roles, s.hashedUsers, s.userOrder = u.plain, u.roles, u.hashed, u.order
+	s.plainUsers = plain
+	s.displayNames = u.names
+	s.authMu.Lock()
+	clear(s.authCache)
+	s.authMu.Unlock()
+	s.usersMu.Unlock()
+	return nil
+}
+
+// reloadUsers re-reads the users file, keeping the current users if that
+// fails. Called on SIGHUP.
+func (s *Server) reloadUsers() {
+	if err := s.loadUsers(); err != nil {
+		logError("Failed to reload users, keeping the previous ones: %v", err)
+		return
+	}
+	s.usersMu.RLock()
+	n := len(s.userOrder)
+	s.usersMu.RUnlock()
+	logInfo("Loaded %d user(s) from %s", n, s.cfg.UsersFile)
+}
+
+// errTooManyUsers stops loadFile once the userSet holds max users.
+var errTooManyUsers = errors.New("too many users")
+
+// userSet is the whitelist being read by loadUsers.
+type userSet struct {
+	plain     map[string]bool   // Plaintext tokens
+	roles     map[string]string // Role by user ID
+	names     map[string]string // Display name by user ID, from JSON files
+	hashed    []hashedUser
+	order     []string // User IDs in file order
+	max       int      // Users allowed, see Config.MaxUsers
+	skipped   int      // Malformed lines ignored, see loadFile
+	truncated bool     // A user past max was found and ignored
+}
+
+// newUserSet returns an empty userSet that accepts up to max users.
+func newUserSet(max int) *userSet {
+	return &userSet{
+		plain: make(map[string]bool),
+		roles: make(map[string]string),
+		names: make(map[string]string),
+		max:   max,
+	}
+}
+
+// add checks that one more user fits in the set, marking it truncated and
+// returning errTooManyUsers otherwise.
+func (u *userSet) add() error {
+	if len(u.order) >= u.max {
+		u.truncated = true
+		return errTooManyUsers
+	}
+	return nil
+}
+
+// loadFile adds the users listed in one file and returns how many of
+// them were plaintext tokens. Files named *.json or starting with '{' are
+// read by loadJSON; the others list one user per line.
+// Each non-empty line is either a hashed entry (NAME:pbkdf2-sha256$...,
+// see newHashedLine) or, for compatibility, a plaintext token that doubles
+// as the user ID. Either may end in ":ro", ":rw" or ":admin" to set the
+// user's role (see cutRole). Lines containing control characters or a
+// token longer than maxTokenLen are counted in skipped and ignored;
+// errTooManyUsers is returned once the set is full.
+func (u *userSet) loadFile(filename string) (int, error) {
+	if isJSONUsersFile(filename) {
+		return u.loadJSON(filename)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	plaintext := 0
+	lineNo := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.IndexFunc(line, unicode.IsControl) >= 0 {
+			u.skipped++
+			continue
+		}
+		line, role := cutRole(line)
+
+		hu, isHashed, err := parseHashedLine(line)
+		if err != nil {
+			return plaintext, fmt.Errorf("%s line %d: %w", filename, lineNo, err)
+		}
+		if isHashed {
+			if _, err := u.addHashed(hu, role); err != nil {
+				return plaintext, err
+			}
+			continue
+		}
+
+		added, err := u.addPlain(line, role)
+		if err != nil {
+			return plaintext, err
+		}
+		if added {
+			plaintext++
+		}
+	}
+	return plaintext, scanner.Err()
+}
+
+// usersFile is the JSON form of a users file, e.g.
+//
+//	{"users": [
+//	  {"name": "PAUL", "hash": "pbkdf2-sha256$100000$...$...", "display_name": "Paul"},
+//	  {"token": "MARIA", "role": "ro"}
+//	]}
+//
+// 'budget -migrate-users' converts a line-based file to this form.
+type usersFile struct {
+	Users []userEntry `json:"users"`
+}
+
+// userEntry is one user of a usersFile. It has either a Hash, in the format
+// of the hashed lines without the NAME: prefix, together with the Name used
+// as the user ID, or a plaintext Token that doubles as the user ID. Role is
+// optional and defaults to read-write.
+type userEntry struct {
+	Name        string `json:"name,omitempty"`
+	Token       string `json:"token,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	Role        string `json:"role,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// isJSONUsersFile reports whether a users file is in the JSON format: it
+// is named *.json or its first non-blank character is '{'.
+func isJSONUsersFile(filename string) bool {
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		return true
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return false // Reported by the caller when it opens the file
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	trimmed := bytes.TrimLeftFunc(head[:n], unicode.IsSpace)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// loadJSON adds the users of a JSON users file (see usersFile) and returns
+// how many of them were plaintext tokens. Entries are checked like the
+// lines of a line-based file.
+func (u *userSet) loadJSON(filename string) (int, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	var f usersFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return 0, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	plaintext := 0
+	for i, e := range f.Users {
+		fail := func(msg string) (int, error) {
+			return plaintext, fmt.Errorf("%s user %d: %s", filename, i+1, msg)
+		}
+		role := e.Role
+		switch role {
+		case "":
+			role = roleReadWrite
+		case roleReadOnly, roleReadWrite, roleAdmin:
+		default:
+			return fail(fmt.Sprintf("unknown role %q", e.Role))
+		}
+		if strings.IndexFunc(e.Name+e.Token+e.Hash+e.DisplayName, unicode.IsControl) >= 0 {
+			u.skipped++
+			continue
+		}
+
+		var added bool
+		switch {
+		case e.Hash != "" && e.Token != "":
+			return fail("has both a token and a hash")
+		case e.Hash != "":
+			if e.Name == "" || strings.Contains(e.Name, ":") {
+				return fail("a hashed entry needs a name without ':'")
+			}
+			hu, isHashed, err := parseHashedLine(e.Name + ":" + e.Hash)
+			if err != nil {
+				return fail(err.Error())
+			}
+			if !isHashed {
+				return fail("hash must start with " + hashScheme + "$")
+			}
+			if added, err = u.addHashed(hu, role); err != nil {
+				return plaintext, err
+			}
+		case e.Token != "":
+			if e.Name != "" && e.Name != e.Token {
+				return fail("a plaintext token is its own user ID, so it can't have a name")
+			}
+			if added, err = u.addPlain(e.Token, role); err != nil {
+				return plaintext, err
+			}
+			if added {
+				plaintext++
+			}
+		default:
+			return fail("needs a token or a hash")
+		}
+		if added && e.DisplayName != "" {
+			u.names[u.order[len(u.order)-1]] = e.DisplayName
+		}
+	}
+	return plaintext, nil
+}
+
+// addHashed adds a hashed user with the given role unless the user ID is
+// already known or too long (counted in skipped), and reports whether it
+// was added.
+func (u *userSet) addHashed(hu hashedUser, role string) (bool, error) {
+	if len(hu.name) > maxTokenLen {
+		u.skipped++
+		return false, nil
+	}
+	if u.known(hu.name) {
+		return false, nil
+	}
+	if err := u.add(); err != nil {
+		return false, err
+	}
+	u.hashed = append(u.hashed, hu)
+	u.order = append(u.order, hu.name)
+	u.roles[hu.name] = role
+	return true, nil
+}
+
+// addPlain adds a plaintext token with the given role unless it is already
+// known or too long (counted in skipped), and reports whether it was added.
+func (u *userSet) addPlain(token, role string) (bool, error) {
+	if len(token) > maxTokenLen {
+		u.skipped++
+		return false, nil
+	}
+	if u.plain[token] {
+		return false, nil
+	}
+	if err := u.add(); err != nil {
+		return false, err
+	}
+	u.plain[token] = true
+	u.order = append(u.order, token)
+	u.roles[token] = role
+	return true, nil
+}
+
+// cutRole removes an optional ":ro", ":rw" or ":admin" suffix from a users
+// file line and returns the role it sets. Lines without a suffix are
+// read-write.
+func cutRole(line string) (rest, role string) {
+	for _, role := range []string{roleReadOnly, roleReadWrite, roleAdmin} {
+		if rest, ok := strings.CutSuffix(line, ":"+role); ok {
+			return rest, role
+		}
+	}
+	return line, roleReadWrite
+}
+
+// known reports whether a user ID has already been loaded.
+func (u *userSet) known(name string) bool {
+	for _, id := range u.order {
+		if id == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHashedLine parses a NAME:pbkdf2-sha256$<iterations>$<salt>$<hash> entry,
+// with salt and hash in unpadded base64.
+// isHashed is false (and err nil) for lines that are plaintext tokens.
+func parseHashedLine(line string) (hu hashedUser, isHashed bool, err error) {
+	name, rest, found := strings.Cut(line, ":")
+	if !found || !strings.HasPrefix(rest, hashScheme+"$") {
+		return hashedUser{}, false, nil
+	}
+
+	parts := strings.Split(rest, "$")
+	if name == "" || len(parts) != 4 {
+		return hashedUser{}, true, fmt.Errorf("malformed hashed entry")
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return hashedUser{}, true, fmt.Errorf("invalid iteration count %q", parts[1])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return hashedUser{}, true, fmt.Errorf("invalid salt: %w", err)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(hash) != hashKeyLength {
+		return hashedUser{}, true, fmt.Errorf("invalid hash")
+	}
+	return hashedUser{name: name, iter: iter, salt: salt, hash: hash}, true, nil
+}
+
+// hashToken derives the stored hash of a token with PBKDF2-HMAC-SHA256.
+func hashToken(token string, salt []byte, iter int) []byte {
+	key, err := pbkdf2.Key(sha256.New, token, salt, iter, hashKeyLength)
+	if err != nil {
+		// Only possible with an invalid key length, which is a constant
+		panic(err)
+	}
+	return key
+}
+
+// newHashedLine returns a users file line for name that accepts token,
+// using a fresh random salt.
+func newHashedLine(name, token string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hu := hashedUser{name: name, iter: hashIterations, salt: salt, hash: hashToken(token, salt, hashIterations)}
+	return name + ":" + hu.encoded(), nil
+}
+
+// encoded returns the pbkdf2-sha256$<iterations>$<salt>$<hash> part of the
+// users file entry of hu.
+func (hu hashedUser) encoded() string {
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, hu.iter,
+		base64.RawStdEncoding.EncodeToString(hu.salt),
+		base64.RawStdEncoding.EncodeToString(hu.hash))
+}
+
+// authenticate resolves the token presented in the Authorization header to a
+// user ID. Every comparison is constant-time, so how long a failure takes
+// says nothing about how close the token was. Plaintext entries are matched
+// by the SHA-256 of the token, which hides its length too, and all of them
+// are compared even after a match. Hashed entries are checked against the
+// derived key and successful results are cached (keyed by the same SHA-256)
+// so the key derivation only runs once per token. Checking an uncached token
+// costs one derivation per hashed entry, so it first takes that many from
+// the budget of ip (see allowHashing); if that is spent, retry is how long
+// until it allows the check and the token is not looked at.
+func (s *Server) authenticate(token, ip string) (user string, ok bool, retry time.Duration) {
+	if token == "" {
+		return "", false, 0
+	}
+	key := sha256.Sum256([]byte(token))
+
+	s.usersMu.RLock()
+	defer s.usersMu.RUnlock()
+	var plain string
+	for _, pu := range s.plainUsers {
+		if subtle.ConstantTimeCompare(key[:], pu.digest[:]) == 1 {
+			plain = pu.name
+		}
+	}
+	if plain != "" {
+		return plain, true, 0
+	}
+	if len(s.hashedUsers) == 0 {
+		return "", false, 0
+	}
+
+	s.authMu.Lock()
+	name, ok := s.authCache[key]
+	s.authMu.Unlock()
+	if ok {
+		return name, true, 0
+	}
+
+	if ok, retry := s.allowHashing(ip, len(s.hashedUsers)); !ok {
+		return "", false, retry
+	}
+	for _, hu := range s.hashedUsers {
+		if subtle.ConstantTimeCompare(hashToken(token, hu.salt, hu.iter), hu.hash) == 1 {
+			s.authMu.Lock()
+			s.authCache[key] = hu.name
+			s.authMu.Unlock()
+			return hu.name, true, 0
+		}
+	}
+	return "", false, 0
+}
+
+// requestUser returns the user ID that authMiddleware attached to the request.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(ctxUserKey).(string)
+	return user
+}
+
+// requestID returns the ID that authMiddleware attached to the request.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(ctxIDKey).(string)
+	return id
+}
+
+// newRequestID returns a random 16-character hex request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether a client-supplied X-Request-ID can be used
+// as is: 1 to maxRequestIDLen letters, digits, '-', '_' or '.', so that it
+// cannot break up a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestRole returns the role that authMiddleware attached to the request.
+func requestRole(r *http.Request) string {
+	role, _ := r.Context().Value(ctxRoleKey).(string)
+	return role
+}
+
+// loadData reads the data from disk.
+// Supports migration of the legacy binary formats (see parseData); migrated
+// data is immediately re-saved as JSON.
+// Returns nil if file doesn't exist (initial state).
+func (s *Server) loadData() error {
+	data, err := os.ReadFile(s.cfg.DBFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s.seedDefaultBudget()
+		}
+		return err
+	}
+
+	owner := ""
+	if len(s.userOrder) > 0 {
+		owner = s.userOrder[0]
+	}
+	df, migrated, err := parseData(data, owner)
+	if err != nil {
+		return err
+	}
+
+	s.setState(df)
+	if df.Stats != nil {
+		s.stats.load(*df.Stats)
+	}
+	if migrated {
+		logInfo("Migrated %d-byte database to format version %d", len(data), dataVersion)
+		return s.saveData() // immediately save in new format
+	}
+	return nil
+}
+
+// setState replaces the in-memory state with the contents of df. Without
+// saved categories the configured ones apply. Caller must hold the write
+// lock on s.mu, or be starting up.
+func (s *Server) setState(df *dataFile) {
+	s.accounts = df.Accounts
+	s.recurring = df.Recurring
+	s.baselines = df.Baselines
+	s.seq = df.Seq
+	if df.Categories == nil {
+		s.categories = maps.Clone(s.cfg.Categories)
+		return
+	}
+	s.categories = make(map[string]bool, len(df.Categories))
+	for _, c := range df.Categories {
+		s.categories[c] = true
+	}
+}
+
+// seedDefaultBudget gives every user's default account the configured
+// DefaultBudget, with the balance equal to it, and saves the result. It is
+// only called on first run, when there is no data file to load.
+func (s *Server) seedDefaultBudget() error {
+	if s.cfg.DefaultBudget == 0 {
+		return nil
+	}
+	for _, user := range s.userOrder {
+		s.accounts[user] = map[string]*Account{defaultAccountName: {
+			Balance: s.cfg.DefaultBudget,
+			Budget:  s.cfg.DefaultBudget,
+		}}
+	}
+	logInfo("No data file found: applied BUDGET_DEFAULT of %d to %d user(s)", s.cfg.DefaultBudget, len(s.userOrder))
+	return s.saveData()
+}
+
+// parseData decodes the contents of the data file.
+// Besides the current JSON document it accepts the legacy binary formats:
+//   - 4 bytes (Balance) or 8 bytes (Balance + Budget), little-endian, which are
+//     assigned to legacyOwner (the first user listed in the users file);
+//   - the dataMagic multi-account format (see decodeAccounts).
+//
+// Accounts read from any of these, or from a version 1 JSON document, become
+// their user's default account. migrated reports whether an older format was read.
+// Documents with a version newer than dataVersion are rejected rather than
+// risk silently dropping fields this build does not know about.
+func parseData(data []byte, legacyOwner string) (df *dataFile, migrated bool, err error) {
+	if len(data) == 4 || len(data) == 8 {
+		if legacyOwner == "" {
+			return nil, false, fmt.Errorf("cannot migrate legacy data: no users configured")
+		}
+		acct := &Account{Balance: int32(binary.LittleEndian.Uint32(data[0:4]))}
+		if len(data) == 8 {
+			acct.Budget = int32(binary.LittleEndian.Uint32(data[4:8]))
+		}
+		return &dataFile{Version: dataVersion, Accounts: defaultAccounts(map[string]*Account{legacyOwner: acct})}, true, nil
+	}
+
+	if bytes.HasPrefix(data, []byte(dataMagic)) {
+		accounts, err := decodeAccounts(data[len(dataMagic):])
+		if err != nil {
+			return nil, false, err
+		}
+		return &dataFile{Version: dataVersion, Accounts: defaultAccounts(accounts)}, true, nil
+	}
+
+	var head struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, false, fmt.Errorf("invalid data file (%d bytes): %w", len(data), err)
+	}
+	if head.Version < 1 || head.Version > dataVersion {
+		return nil, false, fmt.Errorf("unsupported data file version %d (this build supports up to %d)", head.Version, dataVersion)
+	}
+
+	if head.Version == 1 {
+		var v1 struct {
+			Accounts  map[string]*Account `json:"accounts"`
+			Recurring []*RecurringRule    `json:"recurring"`
+		}
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return nil, false, fmt.Errorf("invalid version 1 data file: %w", err)
+		}
+		return &dataFile{Version: dataVersion, Accounts: defaultAccounts(v1.Accounts), Recurring: v1.Recurring}, true, nil
+	}
+
+	df = &dataFile{}
+	if err := json.Unmarshal(data, df); err != nil {
+		return nil, false, fmt.Errorf("invalid data file (%d bytes): %w", len(data), err)
+	}
+	if df.Accounts == nil {
+		df.Accounts = make(map[string]map[string]*Account)
+	}
+	return df, false, nil
+}
+
+// defaultAccounts nests single per-user accounts, as stored by the older
+// formats, under defaultAccountName.
+func defaultAccounts(byUser map[string]*Account) map[string]map[string]*Account {
+	accounts := make(map[string]map[string]*Account, len(byUser))
+	for user, acct := range byUser {
+		accounts[user] = map[string]*Account{defaultAccountName: acct}
+	}
+	return accounts
+}
+
+// decodeAccounts parses the records of the legacy multi-account binary format:
+// one record per account of [2-byte name length][name][4-byte balance][4-byte budget],
+// little-endian, following the dataMagic header.
+func decodeAccounts(rest []byte) (map[string]*Account, error) {
+	accounts := make(map[string]*Account)
+	for len(rest) > 0 {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("truncated account record")
+		}
+		n := int(binary.LittleEndian.Uint16(rest[0:2]))
+		rest = rest[2:]
+		if len(rest) < n+8 {
+			return nil, fmt.Errorf("truncated account record")
+		}
+		name := string(rest[:n])
+		accounts[name] = &Account{
+			Balance: int32(binary.LittleEndian.Uint32(rest[n : n+4])),
+			Budget:  int32(binary.LittleEndian.Uint32(rest[n+4 : n+8])),
+		}
+		rest = rest[n+8:]
+	}
+	return accounts, nil
+}
+
+// encodeData serializes the current state as the versioned JSON document.
+// Caller must hold s.mu.
+func (s *Server) encodeData() ([]byte, error) {
+	df := dataFile{
+		Version:    dataVersion,
+		Accounts:   s.accounts,
+		Recurring:  s.recurring,
+		Categories: s.categoryList(),
+		Seq:        s.seq,
+		Baselines:  s.baselines,
+	}
+	stats := s.stats.snapshot()
+	df.Stats = &stats
+	return json.MarshalIndent(df, "", "  ")
+}
+
+// saveData writes the current state to disk as JSON (see encodeData).
+// Caller must hold the write lock on s.mu.
+// It uses an atomic save strategy: write to temp file -> sync -> rename.
+// The temp file sits next to the data file so the rename never crosses filesystems;
+// on POSIX a crash therefore leaves either the old or the new file intact.
+// A failed save leaves dirty as it was: callers undo their own change, so
+// flush only retries state that was already meant to be kept, such as seq
+// after a logged transaction, and never the change of a request answered
+// with an error.
+func (s *Server) saveData() (err error) {
+	statsUnsaved := s.stats.unsaved.Swap(false)
+	defer func() {
+		if err != nil && statsUnsaved {
+			s.stats.unsaved.Store(true)
+		}
+	}()
+	data, err := s.encodeData()
+	if err != nil {
+		return err
+	}
+
+	// 1. Write to a temporary file in the same directory as the data file
+	dbFile := s.cfg.DBFile
+	tmpFile := filepath.Join(filepath.Dir(dbFile), filepath.Base(dbFile)+".tmp")
+	f, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.cfg.FileMode)
+	if err != nil {
+		return err
+	}
+
+	// Any failure before the rename leaves a partial temp file behind; remove it
+	// so a later run never mistakes it for valid data.
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		return fail(err)
+	}
+
+	// 2. Sync to ensure data is on physical disk
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+
+	// Close explicitly before rename (required on Windows)
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	// 3. Atomic Rename
+	if err := os.Rename(tmpFile, dbFile); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	s.dirty = false
+	s.modified = time.Now()
+	return nil
+}
+
+// errTooManyAccounts is returned by account when a user already has
+// Config.MaxAccounts accounts.
+var errTooManyAccounts = errors.New("too many accounts")
+
+// runFlush calls flush every FlushInterval until ctx is done.
+func (s *Server) runFlush(ctx context.Context, saveState bool) {
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.flush(saveState)
+		}
+	}
+}
+
+// flush is a safety net behind the saves done by each write: it saves the
+// state if something changed it without saving, such as the sequence
+// numbers issued by logTransaction, unless saveState is false, and syncs
+// the log files if they were written to since the last flush.
+func (s *Server) flush(saveState bool) {
+	s.mu.Lock()
+	if saveState && (s.dirty || s.stats.unsaved.Load()) {
+		if err := s.saveData(); err != nil {
+			logError("Error saving data: %v", err)
+		}
+	}
+	s.mu.Unlock()
+
+	loggers := []*ThreadSafeLogger{s.transLogger, s.unauthLogger}
+	if s.accessLogger != nil {
+		loggers = append(loggers, s.accessLogger)
+	}
+	for _, l := range loggers {
+		if err := l.Sync(); err != nil {
+			logError("Error syncing %s: %v", l.filename, err)
+		}
+	}
+}
+
+// runBackups backs up the data file every BackupInterval until ctx is done.
+func (s *Server) runBackups(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.BackupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.backupData(); err != nil {
+				logError("Error backing up data: %v", err)
+			}
+		}
+	}
+}
+
+// runPrune prunes the transaction log at once and then every pruneInterval
+// until ctx is done.
+func (s *Server) runPrune(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.pruneTransactions(s.now()); err != nil {
+			logError("Error pruning transaction log: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneTransactions removes the transactions dated more than RetentionDays
+// before now from the transaction log, and from the in-memory index to
+// match. With LogArchive the removed records are first appended to
+// <TransLogFile>.archive.<date>. Lines that do not start with a date are
+// kept as they are. Rotated backups of the log are left to LogKeep.
+func (s *Server) pruneTransactions(now time.Time) error {
+	cutoff := now.AddDate(0, 0, -s.cfg.RetentionDays).Format("2006-01-02")
+
+	var archive *os.File
+	var archiveName string
+	defer func() {
+		if archive != nil {
+			archive.Close()
+		}
+	}()
+
+	pruned := 0
+	err := s.transLogger.Rewrite(func(r io.Reader, w io.Writer) error {
+		br := r.(*bufio.Reader)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				date, _, _ := strings.Cut(line, ",")
+				if !isDate(date) || date >= cutoff {
+					if _, err := io.WriteString(w, line); err != nil {
+						return err
+					}
+				} else {
+					if s.cfg.LogArchive {
+						if archive == nil {
+							archiveName = s.cfg.TransLogFile + ".archive." + now.Format("2006-01-02")
+							f, err := os.OpenFile(archiveName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, s.cfg.FileMode)
+							if err != nil {
+								return err
+							}
+							archive = f
+						}
+						if _, err := io.WriteString(archive, line); err != nil {
+							return err
+						}
+					}
+					pruned++
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// The archive must be safe on disk before the records leave the log
+		if archive != nil {
+			return archive.Sync()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.txIndex.dropBefore(cutoff)
+	if pruned > 0 {
+		if archive != nil {
+			logInfo("Pruned %d transaction(s) dated before %s from %s, archived in %s", pruned, cutoff, s.cfg.TransLogFile, archiveName)
+		} else {
+			logInfo("Pruned %d transaction(s) dated before %s from %s", pruned, cutoff, s.cfg.TransLogFile)
+		}
+	}
+	return nil
+}
+
+// backupData copies the data file to <DBFile>.bak.<timestamp> and prunes the
+// oldest backups beyond BackupKeep. The file is read under the read lock, so
+// it can't be replaced by saveData halfway through the copy. A missing data
+// file is not an error.
+func (s *Server) backupData() error {
+	s.mu.RLock()
+	data, err := os.ReadFile(s.cfg.DBFile)
+	s.mu.RUnlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// Write under a temporary name first so a crash never leaves a
+	// truncated file that looks like a complete backup
+	backup := s.cfg.DBFile + ".bak." + time.Now().Format("2006-01-02T15-04-05")
+	if err := os.WriteFile(backup+".tmp", data, s.cfg.FileMode); err != nil {
+		os.Remove(backup + ".tmp")
+		return err
+	}
+	if err := os.Rename(backup+".tmp", backup); err != nil {
+		os.Remove(backup + ".tmp")
+		return err
+	}
+	return s.pruneBackups()
+}
+
+// pruneBackups removes all but the newest BackupKeep data file backups.
+// The timestamp suffix sorts chronologically, so a name sort is enough.
+func (s *Server) pruneBackups() error {
+	backups, err := filepath.Glob(s.cfg.DBFile + ".bak.*")
+	if err != nil {
+		return err
+	}
+	var complete []string
+	for _, b := range backups {
+		if !strings.HasSuffix(b, ".tmp") {
+			complete = append(complete, b)
+		}
+	}
+	sort.Strings(complete)
+	for len(complete) > s.cfg.BackupKeep {
+		if err := os.Remove(complete[0]); err != nil {
+			return err
+		}
+		complete = complete[1:]
+	}
+	return nil
+}
+
+// account returns the named account of the given user, creating an empty one
+// on first use (see checkAccountLimit). Caller must hold the write lock on s.mu.
+func (s *Server) account(user, name string) (*Account, error) {
+	if acct, ok := s.accounts[user][name]; ok {
+		return acct, nil
+	}
+	if err := s.checkAccountLimit(user, name); err != nil {
+		return nil, err
+	}
+	if s.accounts[user] == nil {
+		s.accounts[user] = make(map[string]*Account)
+	}
+	acct := &Account{}
+	s.accounts[user][name] = acct
+	return acct, nil
+}
+
+// checkAccountLimit reports errTooManyAccounts if the named account does not
+// exist yet and the user cannot create another one. Caller must hold s.mu.
+func (s *Server) checkAccountLimit(user, name string) error {
+	accts := s.accounts[user]
+	if _, ok := accts[name]; !ok && len(accts) >= s.cfg.MaxAccounts {
+		return errTooManyAccounts
+	}
+	return nil
+}
+
+// peekAccount returns a copy of the named account, or a zero Account if the
+// user has not written to it yet. Caller must hold s.mu (read or write).
+func (s *Server) peekAccount(user, name string) Account {
+	if acct, ok := s.accounts[user][name]; ok {
+		return *acct
+	}
+	return Account{}
+}
+
+// validAccountName reports whether name may be used as an account name:
+// 1 to maxAccountNameLen lowercase letters, digits, '-' or '_'.
+func validAccountName(name string) bool {
+	return validName(name, maxAccountNameLen)
+}
+
+// validName reports whether name is 1 to maxLen characters from [a-z0-9_-].
+func validName(name string, maxLen int) bool {
+	if name == "" || len(name) > maxLen {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// accountScoped rejects requests to the /accounts/{name}/... routes whose
+// account name is invalid before calling next.
+func accountScoped(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validAccountName(r.PathValue("name")) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidAccount, "Invalid account name")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requestAccount returns the account name from the request path, or
+// defaultAccountName for the unscoped routes.
+func requestAccount(r *http.Request) string {
+	if name := r.PathValue("name"); name != "" {
+		return name
+	}
+	return defaultAccountName
+}
+
+// writeAccountError responds to an error returned by s.account.
+func writeAccountError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTooManyAccounts) {
+		writeError(w, http.StatusBadRequest, errCodeTooManyAccounts, "Too many accounts")
+		return
+	}
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// setCORSHeaders adds the CORS response headers. Without a configured
+// allowlist any origin is allowed ("*"); otherwise the request's Origin is
+// echoed back only if listed, and nothing is added for others. It reports
+// whether the origin is allowed.
+func (s *Server) setCORSHeaders(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.cfg.CORSOrigins) == 0 {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// The response depends on Origin, so caches must key on it
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if !s.cfg.CORSOrigins[normalizeOrigin(origin)] {
+			return false
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, If-None-Match, If-Modified-Since, Idempotency-Key, X-Request-ID, X-Confirm-Token")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Response-Format, X-Dry-Run, ETag, Idempotent-Replayed, X-Request-ID, X-Confirm-Token, X-Category-Over-Budget, X-Truncated")
+	return true
+}
+
+// authMiddleware enforces presence of a valid 'Authorization' header.
+// Responds with 401 Unauthorized if the user is not in the whitelist.
+func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), ctxIDKey, id))
+
+		allowed := s.setCORSHeaders(w, r)
+		if r.Method == "OPTIONS" {
+			if !allowed {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// Addresses that keep sending bad tokens are refused without
+		// looking at the token, to slow down guessing
+		ip := s.clientIP(r)
+		if locked, retry := s.lockedOut(ip); locked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			http.Error(w, "Too many failed logins", http.StatusTooManyRequests)
+			return
+		}
+
+		// Unknown tokens are checked against every hashed entry, so the
+		// number of checks per address is limited before any is made
+		token := r.Header.Get("Authorization")
+		user, ok, retry := s.authenticate(token, ip)
+		if retry > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			http.Error(w, "Too many login attempts", http.StatusTooManyRequests)
+			return
+		}
+		if !ok {
+			s.logUnauthorized(token, ip)
+			s.recordAuthFailure(ip)
+			s.metrics.unauthorized.Add(1)
+			s.stats.add(&s.stats.unauthorized, 1)
+			if d := s.authFailureDelay(); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-r.Context().Done():
+				}
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Rate limiting only applies to authenticated users
+		if ok, retry := s.allowRequest(user); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ctxUserKey, user)
+		s.usersMu.RLock()
+		role := s.roles[user]
+		s.usersMu.RUnlock()
+		r = r.WithContext(context.WithValue(ctx, ctxRoleKey, role))
+
+		// Reads are only recorded once they have been answered, and only
+		// if they succeeded
+		if s.accessLogger != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next(sw, r)
+			if sw.status < http.StatusBadRequest {
+				s.logAccess(user, r.URL.Path, sw.status)
+			}
+			return
+		}
+		next(w, r)
+	}
+}
+
+// statusWriter passes a response through, noting its status code.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// writable guards the handlers that change state: requests from read-only
+// users get 403 Forbidden and are recorded in the unauthorized log, except
+// GET and HEAD, which routes serving both reads and writes allow.
+func (s *Server) writable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestRole(r) == roleReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.logForbidden(requestUser(r), s.clientIP(r), unauthReasonReadOnly)
+			http.Error(w, "Forbidden: read-only token", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminOnly guards the /admin routes: requests from users without the admin
+// role get 403 Forbidden and are recorded in the unauthorized log.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestRole(r) != roleAdmin {
+			s.logForbidden(requestUser(r), s.clientIP(r), unauthReasonNotAdmin)
+			http.Error(w, "Forbidden: admin token required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// idempotent makes a write handler safe to retry. The first request carrying
+// an Idempotency-Key header is handled normally and its response kept for
+// IdempotencyTTL; repeats with the same key from the same user get that
+// response again, marked with Idempotent-Replayed, without re-applying it.
+// Server errors and requests for confirmation (see confirmSpend) are not
+// kept, so the request can be retried or confirmed. A repeat that
+// arrives while the first is in flight, or that targets another endpoint,
+// gets 409. Requests without the header are passed through unchanged.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Idempotency-Key")
+		if header == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(header) > maxIdempotencyKey {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Idempotency-Key too long")
+			return
+		}
+
+		key := idempotencyKey{user: requestUser(r), key: header}
+		now := time.Now()
+
+		s.idemMu.Lock()
+		// Expired results are swept at most once a minute
+		if now.Sub(s.idemSweep) > time.Minute {
+			for k, res := range s.idemResults {
+				if now.After(res.expires) {
+					delete(s.idemResults, k)
+				}
+			}
+			s.idemSweep = now
+		}
+		res, ok := s.idemResults[key]
+		if ok && now.After(res.expires) {
+			ok = false
+		}
+		if !ok {
+			res = &idempotentResult{path: r.URL.Path, expires: now.Add(s.cfg.IdempotencyTTL)}
+			s.idemResults[key] = res
+		}
+		s.idemMu.Unlock()
+
+		if ok {
+			switch {
+			case res.path != r.URL.Path:
+				writeError(w, http.StatusConflict, errCodeIdempotencyConflict, "Idempotency-Key was used for another request")
+			case !res.done:
+				writeError(w, http.StatusConflict, errCodeIdempotencyConflict, "A request with this Idempotency-Key is in progress")
+			default:
+				for k, v := range res.header {
+					w.Header()[k] = v
+				}
+				w.Header().Set("X-Request-ID", requestID(r))
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(res.status)
+				w.Write(res.body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		s.idemMu.Lock()
+		defer s.idemMu.Unlock()
+		if rec.status >= 500 || rec.Header().Get("X-Confirm-Token") != "" {
+			delete(s.idemResults, key)
+			return
+		}
+		res.done = true
+		res.status = rec.status
+		res.header = rec.Header().Clone()
+		res.body = rec.body.Bytes()
+		res.expires = time.Now().Add(s.cfg.IdempotencyTTL)
+	}
+}
+
+// ConfirmationResponse defines the 409 response to a /spend above
+// Config.ConfirmAbove that was not confirmed. Preview is the account as the
+// spend would leave it. Resending the same spend with Token in an
+// X-Confirm-Token header before Expires (RFC 3339) applies it.
+type ConfirmationResponse struct {
+	ErrorResponse
+	Token   string      `json:"confirm_token"`
+	Expires string      `json:"expires"`
+	Preview GetResponse `json:"preview"`
+}
+
+// requestConfirmation responds 409 with a new single-use token confirming
+// spend, and the effect the spend would have. Caller must hold s.mu.
+func (s *Server) requestConfirmation(w http.ResponseWriter, r *http.Request, spend pendingSpend, preview *Account) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	spend.expires = now.Add(s.cfg.ConfirmTTL)
+
+	s.pendingMu.Lock()
+	// Expired tokens are swept at most once a minute
+	if now.Sub(s.pendingSweep) > time.Minute {
+		for k, p := range s.pending {
+			if now.After(p.expires) {
+				delete(s.pending, k)
+			}
+		}
+		s.pendingSweep = now
+	}
+	s.pending[token] = &spend
+	s.pendingMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Confirm-Token", token)
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(ConfirmationResponse{
+		ErrorResponse: ErrorResponse{
+			Error:   errCodeConfirmRequired,
+			Message: fmt.Sprintf("Spends over %d must be confirmed: resend with the X-Confirm-Token header", s.cfg.ConfirmAbove),
+		},
+		Token:   token,
+		Expires: spend.expires.Format(time.RFC3339),
+		Preview: s.accountResponse(spend.user, spend.account, preview),
+	})
+}
+
+// confirmSpend reports whether token confirms spend: it must have been
+// issued for the same user, account, amount and category and not have
+// expired. A token is used up by the first attempt, whether or not it
+// matches.
+func (s *Server) confirmSpend(token string, spend pendingSpend) bool {
+	if token == "" {
+		return false
+	}
+
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	p, ok := s.pending[token]
+	if !ok {
+		return false
+	}
+	delete(s.pending, token)
+	return time.Now().Before(p.expires) && p.user == spend.user && p.account == spend.account &&
+		p.amount == spend.amount && p.category == spend.category
+}
+
+// responseRecorder passes a response through while keeping a copy of its
+// status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// gzipped compresses the responses of a read handler for clients that send
+// Accept-Encoding: gzip, once the body reaches GzipMinBytes; smaller ones
+// are sent as is, as compressing them would save little.
+func (s *Server) gzipped(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minBytes: s.cfg.GzipMinBytes, status: http.StatusOK}
+		defer gw.finish()
+		next(gw, r)
+	}
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding lists gzip
+// without ruling it out with q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				q, err := strconv.ParseFloat(v, 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the status and body until minBytes have
+// been written, then switches to gzip. finish sends whatever is still held
+// back, uncompressed, and closes the gzip stream.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes int
+	status   int
+	buf      []byte
+	gz       *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	g.status = status
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	g.buf = append(g.buf, b...)
+	if len(g.buf) < g.minBytes || g.status != http.StatusOK || g.Header().Get("Content-Encoding") != "" {
+		return len(b), nil
+	}
+
+	// Content-Type must be sniffed from the plain body, not the compressed one
+	h := g.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(g.buf))
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	if _, err := g.gz.Write(g.buf); err != nil {
+		return 0, err
+	}
+	g.buf = nil
+	return len(b), nil
+}
+
+func (g *gzipResponseWriter) finish() {
+	if g.gz != nil {
+		g.gz.Close()
+		return
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	g.ResponseWriter.Write(g.buf)
+}
+
+// allowRequest takes one token from the user's bucket.
+// If the bucket is empty it returns false and how long until a token is available.
+func (s *Server) allowRequest(user string) (bool, time.Duration) {
+	if s.cfg.RateLimit <= 0 {
+		return true, 0
+	}
+
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+
+	now := time.Now()
+	capacity := float64(s.cfg.RateLimit)
+	perSecond := capacity / 60
+
+	// Drop buckets that have been idle long enough to be full again; they are
+	// indistinguishable from a fresh bucket, so memory stays bounded.
+	if now.Sub(s.lastSweep) > time.Minute {
+		for u, b := range s.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(s.buckets, u)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[user]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		s.buckets[user] = b
+	}
+
+	b.tokens = min(capacity, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// allowHashing takes n tokens, but no more than HashLimit, from the hashed
+// token check bucket of ip's address, before authenticate derives n keys.
+// If the bucket holds too few it returns false and how long until it will.
+func (s *Server) allowHashing(ip string, n int) (bool, time.Duration) {
+	if s.cfg.HashLimit <= 0 {
+		return true, 0
+	}
+	addr := lockoutAddr(ip)
+
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+
+	now := time.Now()
+	capacity := float64(s.cfg.HashLimit)
+	perSecond := capacity / 60
+	cost := min(float64(n), capacity)
+
+	// Full buckets are dropped, as in allowRequest
+	if now.Sub(s.hashSweep) > time.Minute {
+		for a, b := range s.hashBuckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(s.hashBuckets, a)
+			}
+		}
+		s.hashSweep = now
+	}
+
+	b, ok := s.hashBuckets[addr]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		s.hashBuckets[addr] = b
+	}
+
+	b.tokens = min(capacity, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens < cost {
+		wait := time.Duration((cost - b.tokens) / perSecond * float64(time.Second))
+		return false, max(wait, time.Millisecond)
+	}
+	b.tokens -= cost
+	return true, 0
+}
+
+// authFailureDelay returns how long to hold back the response to a failed
+// login: Config.AuthFailDelay plus a random part of up to as much again, so
+// that failures take long enough, and vary enough, for the time spent
+// checking the token not to show. Successful logins are never delayed.
+func (s *Server) authFailureDelay() time.Duration {
+	d := s.cfg.AuthFailDelay
+	if d <= 0 {
+		return 0
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return d + time.Duration(binary.BigEndian.Uint64(b[:])%uint64(d))
+}
+
+// lockoutAddr returns the part of a clientIP result that failed logins are
+// counted against: the address without the port, which differs between
+// connections.
+func lockoutAddr(ip string) string {
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
+
+// lockedOut reports whether ip is locked out after too many failed logins
+// (see recordAuthFailure) and, if so, for how much longer.
+func (s *Server) lockedOut(ip string) (bool, time.Duration) {
+	if s.cfg.LockoutFails <= 0 {
+		return false, 0
+	}
+
+	s.lockoutMu.Lock()
+	defer s.lockoutMu.Unlock()
+
+	f, ok := s.failures[lockoutAddr(ip)]
+	if !ok {
+		return false, 0
+	}
+	if wait := time.Until(f.until); wait > 0 {
+		return true, wait
+	}
+	return false, 0
+}
+
+// recordAuthFailure counts a failed login from ip. The count restarts once
+// Config.LockoutWindow has passed since the first failure it includes, and
+// only then: successful logins from the address leave it alone, or anyone
+// holding a valid token could keep guessing by slipping one in. When
+// it reaches Config.LockoutFails the address is locked out for
+// Config.LockoutDuration, which is logged.
+func (s *Server) recordAuthFailure(ip string) {
+	if s.cfg.LockoutFails <= 0 {
+		return
+	}
+	addr := lockoutAddr(ip)
+	now := time.Now()
+
+	s.lockoutMu.Lock()
+	// Entries whose window and lockout are both over are swept at most
+	// once a minute, so memory stays bounded
+	if now.Sub(s.failSweep) > time.Minute {
+		for a, f := range s.failures {
+			if now.Sub(f.first) > s.cfg.LockoutWindow && now.After(f.until) {
+				delete(s.failures, a)
+			}
+		}
+		s.failSweep = now
+	}
+
+	f, ok := s.failures[addr]
+	if !ok || now.Sub(f.first) > s.cfg.LockoutWindow {
+		f = &authFailures{first: now}
+		s.failures[addr] = f
+	}
+	f.count++
+	locked := f.count >= s.cfg.LockoutFails
+	if locked {
+		f.until = now.Add(s.cfg.LockoutDuration)
+		f.count, f.first = 0, now
+	}
+	s.lockoutMu.Unlock()
+
+	if locked {
+		logWarn("Locking out %s for %s after %d failed logins", addr, s.cfg.LockoutDuration, s.cfg.LockoutFails)
+		s.logForbidden("", ip, unauthReasonLockedOut)
+	}
+}
+
+// handleGet returns the current balance and budget as JSON.
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.rlock(r)
+	defer s.mu.RUnlock()
+
+	// Accounts that have not been written yet simply read as zero
+	acct := s.peekAccount(user, name)
+	if s.notModified(w, r, &acct) {
+		return
+	}
+	s.writeAccountJSON(w, r, &acct)
+}
+
+// subscriber is an /events client following one account. ch holds at most
+// one wake-up, so changes made while the client is still being sent an
+// earlier one are coalesced into a single event with the latest state.
+type subscriber struct {
+	user    string
+	account string
+	ch      chan struct{}
+}
+
+// handleEvents streams the caller's account as Server-Sent Events, for
+// clients that would otherwise poll /get. A "balance" event carrying the
+// GetResponse JSON is sent straight away and after each change to the
+// account, and a comment every eventKeepAlive so that proxies don't close an
+// idle stream. It is a read, so read-only users may subscribe too. The
+// stream runs until the client disconnects or the server shuts down.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	// The stream outlives the server's read and write timeouts, either of
+	// which would otherwise cut it off
+	rc := http.NewResponseController(w)
+	if err := errors.Join(rc.SetReadDeadline(time.Time{}), rc.SetWriteDeadline(time.Time{})); err != nil {
+		logRequestError(r, "Cannot stream events: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	sub := s.subscribe(user, name)
+	defer s.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stops nginx buffering the stream
+
+	send := func() error {
+		s.rlock(r)
+		acct := s.peekAccount(user, name)
+		resp := s.accountResponse(user, name, &acct)
+		s.mu.RUnlock()
+
+		data, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: balance\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	err := send()
+	for err == nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case <-sub.ch:
+			err = send()
+		case <-keepAlive.C:
+			if _, err = io.WriteString(w, ": keep-alive\n\n"); err == nil {
+				err = rc.Flush()
+			}
+		}
+	}
+}
+
+// subscribe registers an /events client for the user's named account.
+func (s *Server) subscribe(user, name string) *subscriber {
+	sub := &subscriber{user: user, account: name, ch: make(chan struct{}, 1)}
+	s.eventsMu.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.eventsMu.Unlock()
+	return sub
+}
+
+// unsubscribe removes an /events client once its stream has ended.
+func (s *Server) unsubscribe(sub *subscriber) {
+	s.eventsMu.Lock()
+	delete(s.subscribers, sub)
+	s.eventsMu.Unlock()
+}
+
+// notifySubscribers wakes the /events clients following the user's named
+// account. It never blocks: a client with a wake-up still pending will pick
+// up this change along with it.
+func (s *Server) notifySubscribers(user, name string) {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	for sub := range s.subscribers {
+		if sub.user == user && sub.account == name {
+			select {
+			case sub.ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// notModified sets the validators of a /get response for acct and, if the
+// client's copy is still current, responds 304 Not Modified and returns
+// true. If-None-Match is checked against the account's ETag and, as RFC 9110
+// requires, takes precedence over If-Modified-Since, which is checked
+// against lastModified. A match on the ETag only vouches for the account:
+// seq, which counts every user's transactions, may have moved on.
+// Caller must hold s.mu.
+func (s *Server) notModified(w http.ResponseWriter, r *http.Request, acct *Account) bool {
+	etag := accountETag(acct)
+	modified := s.lastModified(s.now())
+	w.Header().Set("Cache-Control", "no-cache")
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	current := false
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				current = true
+				break
+			}
+		}
+	} else if header := r.Header.Get("If-Modified-Since"); header != "" && !modified.IsZero() {
+		since, err := http.ParseTime(header)
+		current = err == nil && !modified.After(since)
+	}
+	if !current {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// lastModified returns when the responses of /get last changed, to the
+// second: the last change to the state or, as Spent restarts then, the
+// start of the budget cycle, whichever is later. It returns the zero time
+// during the second of that change, as another change within the same
+// second would not move Last-Modified and a client could keep a stale copy.
+// Caller must hold s.mu.
+func (s *Server) lastModified(now time.Time) time.Time {
+	start, _ := cycleWindow(now, s.cfg.CycleDay)
+	modified := s.modified.Truncate(time.Second)
+	if start.After(modified) {
+		modified = start
+	}
+	if !now.Truncate(time.Second).After(modified) {
+		return time.Time{}
+	}
+	return modified
+}
+
+// ProgressResponse defines the JSON response for the budget progress endpoint.
+// Spent covers the current budget cycle (see periodSpent) and PercentUsed is
+// Spent as a percentage of Budget, between 0 and 100. In debt mode an
+// account with a negative budget also gets PercentRepaid, the progress of
+// its balance from the budget towards zero (see percentRepaid).
+//
+// Categories lists the account's category budgets, by category name.
+type ProgressResponse struct {
+	Budget        int32              `json:"budget"`
+	Spent         int64              `json:"spent"`
+	Remaining     int32              `json:"remaining"`
+	PercentUsed   float64            `json:"percent_used"`
+	PercentRepaid *float64           `json:"percent_repaid,omitempty"`
+	Categories    []CategoryProgress `json:"categories,omitempty"`
+}
+
+// CategoryProgress is the state of one category budget this cycle.
+// Remaining is Budget - Spent, negative once the category is overspent.
+type CategoryProgress struct {
+	Category    string  `json:"category"`
+	Budget      int32   `json:"budget"`
+	Spent       int64   `json:"spent"`
+	Remaining   int64   `json:"remaining"`
+	PercentUsed float64 `json:"percent_used"`
+}
+
+// handleProgress reports how much of the budget has been used this cycle,
+// so that every client draws the same progress bar.
+func (s *Server) handleProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.rlock(r)
+	acct := s.peekAccount(user, name)
+	s.mu.RUnlock()
+
+	spent, err := s.periodSpent(user, name, s.now())
+	if err != nil {
+		logRequestError(r, "Error reading transaction log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ProgressResponse{
+		Budget:      acct.Budget,
+		Spent:       spent,
+		Remaining:   acct.Balance,
+		PercentUsed: percentUsed(spent, acct.Budget),
+	}
+	if s.cfg.DebtMode && acct.Budget < 0 {
+		repaid := percentRepaid(acct.Balance, acct.Budget)
+		resp.PercentRepaid = &repaid
+	}
+	if len(acct.CategoryBudgets) > 0 {
+		byCategory, err := s.categorySpent(user, name, s.now())
+		if err != nil {
+			logRequestError(r, "Error reading transaction log: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		for _, c := range slices.Sorted(maps.Keys(acct.CategoryBudgets)) {
+			budget, spent := acct.CategoryBudgets[c], byCategory[c]
+			resp.Categories = append(resp.Categories, CategoryProgress{
+				Category:    c,
+				Budget:      budget,
+				Spent:       spent,
+				Remaining:   int64(budget) - spent,
+				PercentUsed: percentUsed(spent, budget),
+			})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ProjectionResponse defines the JSON response for the projection endpoint.
+// Start and End (YYYY-MM-DD) are the first and last days of the budget
+// cycle; today counts as elapsed. The averages are in minor units, rounded
+// to two decimals, and ProjectedRemaining is the balance the account would
+// end the cycle with if it kept spending at AvgDailySpend.
+type ProjectionResponse struct {
+	Start              string  `json:"start"`
+	End                string  `json:"end"`
+	DaysElapsed        int     `json:"days_elapsed"`
+	DaysRemaining      int     `json:"days_remaining"`
+	Budget             int32   `json:"budget"`
+	Balance            int32   `json:"balance"`
+	Spent              int64   `json:"spent"`
+	AvgDailySpend      float64 `json:"avg_daily_spend"`
+	AvgWeeklySpend     float64 `json:"avg_weekly_spend"`
+	ProjectedRemaining int64   `json:"projected_remaining"`
+	OnTrack            bool    `json:"on_track"`
+}
+
+// handleProjection extrapolates this cycle's spending (see periodSpent) to
+// the end of the cycle, to tell whether the budget will last.
+func (s *Server) handleProjection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+	now := s.now()
+
+	s.rlock(r)
+	acct := s.peekAccount(user, name)
+	s.mu.RUnlock()
+
+	spent, err := s.periodSpent(user, name, now)
+	if err != nil {
+		logRequestError(r, "Error reading transaction log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	start, next := cycleWindow(now, s.cfg.CycleDay)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projectSpending(now, start, next, acct, spent, s.cfg.Rounding))
+}
+
+// projectSpending computes the ProjectionResponse of acct, which has spent
+// spent since start, the beginning of the cycle ending at next. Counting
+// today as elapsed means a cycle that has just started is one day old
+// rather than zero, so the average is always defined. An account without a
+// positive budget has nothing to project against: it is on track as long
+// as it isn't spending. The projected spending is rounded with the given
+// rounding mode.
+func projectSpending(now, start, next time.Time, acct Account, spent int64, rounding string) ProjectionResponse {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	total := calendarDays(start, next)
+	elapsed := min(calendarDays(start, today)+1, total)
+
+	avg := float64(spent) / float64(elapsed)
+	// spent * remaining days / elapsed days, rounded once at the end
+	toCome := roundQuo(new(big.Int).Mul(big.NewInt(spent), big.NewInt(int64(total-elapsed))), big.NewInt(int64(elapsed)), rounding)
+	projected := int64(acct.Balance) - toCome.Int64()
+	resp := ProjectionResponse{
+		Start:              start.Format("2006-01-02"),
+		End:                next.AddDate(0, 0, -1).Format("2006-01-02"),
+		DaysElapsed:        elapsed,
+		DaysRemaining:      total - elapsed,
+		Budget:             acct.Budget,
+		Balance:            acct.Balance,
+		Spent:              spent,
+		AvgDailySpend:      math.Round(avg*100) / 100,
+		AvgWeeklySpend:     math.Round(avg*7*100) / 100,
+		ProjectedRemaining: projected,
+		OnTrack:            projected >= 0,
+	}
+	if acct.Budget <= 0 {
+		resp.OnTrack = spent <= 0
+	}
+	return resp
+}
+
+// calendarDays returns the number of days from midnight from to midnight
+// to, rounding away the hour gained or lost across a DST change.
+func calendarDays(from, to time.Time) int {
+	return int(math.Round(to.Sub(from).Hours() / 24))
+}
+
+// percentRepaid returns how far balance has moved from the debt budget
+// towards zero, as a percentage rounded to two decimals and clamped to
+// 0-100. budget must be negative.
+func percentRepaid(balance, budget int32) float64 {
+	pct := (float64(balance) - float64(budget)) / -float64(budget) * 100
+	return math.Round(min(max(pct, 0), 100)*100) / 100
+}
+
+// percentUsed returns spent as a percentage of budget, rounded to two
+// decimals and clamped to 0-100. Without a budget, any spending counts as
+// 100% used.
+func percentUsed(spent int64, budget int32) float64 {
+	if budget <= 0 {
+		if spent > 0 {
+			return 100
+		}
+		return 0
+	}
+	pct := float64(spent) / float64(budget) * 100
+	return math.Round(min(max(pct, 0), 100)*100) / 100
+}
+
+// CurrencyRequest defines the JSON payload for setting an account's currency.
+type CurrencyRequest struct {
+	Currency string `json:"currency"`
+}
+
+// ConvertResponse defines the JSON response for the convert endpoint.
+// Converted is Balance expressed in minor units of To, rounded to the
+// nearest unit as Config.Rounding says; all currencies share
+// Config.MinorUnits.
+type ConvertResponse struct {
+	Balance   int32   `json:"balance"`
+	Currency  string  `json:"currency"`
+	To        string  `json:"to"`
+	Rate      float64 `json:"rate"`
+	Converted int64   `json:"converted"`
+}
+
+// currencyOf returns the currency of acct, defaulting to Config.Currency.
+func (s *Server) currencyOf(acct *Account) string {
+	if acct.Currency != "" {
+		return acct.Currency
+	}
+	return s.cfg.Currency
+}
+
+// validCurrency reports whether code looks like an ISO 4217 code.
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// loadRates reads the exchange-rate table: a JSON object mapping
+// "FROM/TO" currency pairs to the number of TO units one FROM unit buys,
+// e.g. {"GBP/EUR": 1.17}. Rates are kept as the exact fractions written in
+// the file, not as floats, so conversions round only once.
+func loadRates(filename string) (map[string]*big.Rat, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.Number
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid rates file: %w", err)
+	}
+	rates := make(map[string]*big.Rat, len(raw))
+	for pair, v := range raw {
+		pair = strings.ToUpper(strings.TrimSpace(pair))
+		from, to, ok := strings.Cut(pair, "/")
+		if !ok || !validCurrency(from) || !validCurrency(to) {
+			return nil, fmt.Errorf("invalid currency pair %q", pair)
+		}
+		rate, ok := new(big.Rat).SetString(string(v))
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid rate %v for %s", v, pair)
+		}
+		rates[pair] = rate
+	}
+	return rates, nil
+}
+
+// reloadRates replaces the exchange-rate table from Config.RatesFile,
+// logging the outcome. On failure the previous table stays in use.
+func (s *Server) reloadRates() {
+	if s.cfg.RatesFile == "" {
+		return
+	}
+	rates, err := loadRates(s.cfg.RatesFile)
+	if err != nil {
+		logError("Failed to load exchange rates, keeping the previous ones: %v", err)
+		return
+	}
+	s.ratesMu.Lock()
+	s.rates = rates
+	s.ratesMu.Unlock()
+	logInfo("Loaded %d exchange rate(s) from %s", len(rates), s.cfg.RatesFile)
+}
+
+// rate returns how many units of 'to' one unit of 'from' buys, using the
+// inverse of the opposite pair if only that one is configured. The result
+// must not be modified.
+func (s *Server) rate(from, to string) (*big.Rat, bool) {
+	if from == to {
+		return big.NewRat(1, 1), true
+	}
+	s.ratesMu.RLock()
+	defer s.ratesMu.RUnlock()
+	if r, ok := s.rates[from+"/"+to]; ok {
+		return r, true
+	}
+	if r, ok := s.rates[to+"/"+from]; ok {
+		return new(big.Rat).Inv(r), true
+	}
+	return nil, false
+}
+
+// roundQuo returns num / den rounded to an integer with the given rounding
+// mode, using integer arithmetic only. den must be positive. Both modes round
+// to the nearest integer and differ only on exact halves: roundHalfUp takes
+// them away from zero (2.5 to 3, -2.5 to -3) and roundHalfEven to the even
+// neighbour (2.5 to 2, 3.5 to 4, -2.5 to -2).
+func roundQuo(num, den *big.Int, mode string) *big.Int {
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		return q
+	}
+	// Compare the remainder with half the divisor without dividing
+	cmp := new(big.Int).Lsh(new(big.Int).Abs(rem), 1).Cmp(den)
+	if cmp > 0 || (cmp == 0 && (mode != roundHalfEven || q.Bit(0) == 1)) {
+		// QuoRem truncates towards zero, so move away from it
+		q.Add(q, big.NewInt(int64(num.Sign())))
+	}
+	return q
+}
+
+// handleConvert returns the balance expressed in the currency given by
+// ?to=, using the configured exchange rates. It is display-only and never
+// changes the account.
+func (s *Server) handleConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	to := strings.ToUpper(r.URL.Query().Get("to"))
+	if !validCurrency(to) {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid to currency")
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.rlock(r)
+	acct := s.peekAccount(user, name)
+	s.mu.RUnlock()
+
+	from := s.currencyOf(&acct)
+	rate, ok := s.rate(from, to)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errCodeUnknownRate, fmt.Sprintf("No exchange rate from %s to %s", from, to))
+		return
+	}
+
+	exact := new(big.Rat).Mul(new(big.Rat).SetInt64(int64(acct.Balance)), rate)
+	converted := roundQuo(exact.Num(), exact.Denom(), s.cfg.Rounding)
+	if !converted.IsInt64() {
+		writeError(w, http.StatusBadRequest, errCodeBalanceOverflow, "Converted balance out of range")
+		return
+	}
+	rateFloat, _ := rate.Float64()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConvertResponse{
+		Balance:   acct.Balance,
+		Currency:  from,
+		To:        to,
+		Rate:      rateFloat,
+		Converted: converted.Int64(),
+	})
+}
+
+// FormatResponse defines the JSON response for the format endpoint.
+type FormatResponse struct {
+	Amount    int32  `json:"amount"`
+	Currency  string `json:"currency"`
+	Formatted string `json:"formatted"`
+}
+
+// currencySymbol is how amounts of a currency are written: the symbol and
+// whether it follows the number.
+type currencySymbol struct {
+	symbol string
+	suffix bool
+}
+
+// currencySymbols covers the common currencies; others are written with
+// their ISO 4217 code in front, e.g. "PLN 12.50".
+var currencySymbols = map[string]currencySymbol{
+	"GBP": {"£", false},
+	"EUR": {"€", false},
+	"USD": {"$", false},
+	"AUD": {"A$", false},
+	"CAD": {"C$", false},
+	"NZD": {"NZ$", false},
+	"JPY": {"¥", false},
+	"CNY": {"¥", false},
+	"INR": {"₹", false},
+	"CHF": {"CHF ", false},
+	"SEK": {" kr", true},
+	"NOK": {" kr", true},
+	"DKK": {" kr", true},
+}
+
+// formatAmount writes an amount in minor units as a decimal with
+// minorUnits places, thousands separated by commas, with the currency's
+// symbol, e.g. 123456 GBP with 2 minor units is "£1,234.56".
+func formatAmount(amount int64, minorUnits int32, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	scale := int64(math.Pow10(int(minorUnits)))
+	digits := strconv.FormatInt(amount/scale, 10)
+
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	if minorUnits > 0 {
+		fmt.Fprintf(&b, ".%0*d", minorUnits, amount%scale)
+	}
+
+	sym, ok := currencySymbols[currency]
+	switch {
+	case !ok:
+		return sign + currency + " " + b.String()
+	case sym.suffix:
+		return sign + b.String() + sym.symbol
+	default:
+		return sign + sym.symbol + b.String()
+	}
+}
+
+// handleFormat formats ?amount= (in minor units) for display in the
+// configured currency, or in ?currency= if given, so that clients need not
+// know the symbols or the number of decimal places.
+func (s *Server) handleFormat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	amount, err := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidAmount, "Amount must be an integer number of minor units")
+		return
+	}
+	currency := s.cfg.Currency
+	if v := r.URL.Query().Get("currency"); v != "" {
+		currency = strings.ToUpper(v)
+		if !validCurrency(currency) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid currency")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FormatResponse{
+		Amount:    int32(amount),
+		Currency:  currency,
+		Formatted: formatAmount(amount, s.cfg.MinorUnits, currency),
+	})
+}
+
+// CategoryBudgetRequest defines the JSON payload for setting the budget of
+// one category. A Budget of 0 removes it.
+type CategoryBudgetRequest struct {
+	Category string `json:"category"`
+	Budget   Money  `json:"budget"`
+}
+
+// CategoryBudgetsResponse defines the JSON response for the category budget
+// endpoint: the account's category budgets after the request.
+type CategoryBudgetsResponse struct {
+	Budgets map[string]int32 `json:"budgets"`
+}
+
+// handleCategoryBudget manages the account's category budgets, which cap
+// the spends of a category per budget cycle on top of the overall budget
+// (see Config.CategoryLimit).
+//   - GET lists them.
+//   - POST sets one from a CategoryBudgetRequest body.
+//
+// Like the currency, they are settings of the account rather than
+// transactions: changes are not logged and cannot be undone.
+func (s *Server) handleCategoryBudget(w http.ResponseWriter, r *http.Request) {
+	user, name := requestUser(r), requestAccount(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		s.rlock(r)
+		budgets := s.peekAccount(user, name).CategoryBudgets
+		s.mu.RUnlock()
+
+		if budgets == nil {
+			budgets = map[string]int32{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CategoryBudgetsResponse{Budgets: budgets})
+
+	case http.MethodPost:
+		var req CategoryBudgetRequest
+		if !s.decodeBody(w, r, &req) {
+			return
+		}
+		req.Category = strings.ToLower(strings.TrimSpace(req.Category))
+		budget := int32(req.Budget)
+		if !s.knownCategory(req.Category) {
+			writeError(w, http.StatusBadRequest, errCodeUnknownCategory, "Unknown category")
+			return
+		}
+		if budget < 0 || budget > s.cfg.MaxBalance {
+			writeError(w, http.StatusBadRequest, errCodeInvalidBudget, "Invalid budget amount")
+			return
+		}
+
+		s.lock(r)
+		defer s.mu.Unlock()
+
+		if s.inMaintenance(w) {
+			return
+		}
+
+		if !s.checkIfMatch(w, r, user, name) {
+			return
+		}
+
+		_, existed := s.accounts[user][name]
+		acct, err := s.account(user, name)
+		if err != nil {
+			writeAccountError(w, err)
+			return
+		}
+		budgets := maps.Clone(acct.CategoryBudgets)
+		if budgets == nil {
+			budgets = make(map[string]int32)
+		}
+		if budget == 0 {
+			delete(budgets, req.Category)
+		} else {
+			budgets[req.Category] = budget
+		}
+		before := *acct
+		acct.Version++
+		acct.CategoryBudgets = budgets
+		if len(budgets) == 0 {
+			acct.CategoryBudgets = nil
+		}
+		if err := s.saveData(); err != nil {
+			*acct = before
+			if !existed {
+				delete(s.accounts[user], name)
+			}
+			logRequestError(r, "Error saving data: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("ETag", accountETag(acct))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CategoryBudgetsResponse{Budgets: budgets})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSetCurrency sets the currency of the account. The stored amounts are
+// kept as they are: they are taken to be in the new currency from now on.
+func (s *Server) handleSetCurrency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CurrencyRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+	if !validCurrency(req.Currency) {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Currency must be a three-letter ISO 4217 code")
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Currency = req.Currency
+	if req.Currency == s.cfg.Currency {
+		acct.Currency = ""
+	}
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// Not a transaction, so writeTransaction won't have told /events clients
+	s.notifySubscribers(user, name)
+
+	s.writeAccountJSON(w, r, acct)
+}
+
+// handleUsers lists the configured users and their roles, in users file
+// order. It reflects the users file as last loaded, at startup or on SIGHUP.
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.usersMu.RLock()
+	users := make([]UserInfo, 0, len(s.userOrder))
+	for _, name := range s.userOrder {
+		info := UserInfo{ID: name, Role: s.roles[name], Hashed: !s.users[name], Name: s.displayNames[name]}
+		if !info.Hashed {
+			info.ID = maskToken(name)
+		}
+		users = append(users, info)
+	}
+	s.usersMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// handleBackup downloads the current state in the data file format, as a
+// file that can be put in place of DBFile. The state is encoded under the
+// read lock, so it is a consistent snapshot even while writes continue,
+// and includes any changes not yet flushed to disk.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.rlock(r)
+	data, err := s.encodeData()
+	s.mu.RUnlock()
+	if err != nil {
+		logRequestError(r, "Error encoding data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	base := filepath.Base(s.cfg.DBFile)
+	ext := filepath.Ext(base)
+	filename := strings.TrimSuffix(base, ext) + "-" + time.Now().Format("2006-01-02T15-04-05") + ext
+	logInfo("Backup of %s downloaded via /admin/backup", s.cfg.DBFile)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
+
+// MaintenanceRequest defines the JSON payload for turning maintenance mode
+// on or off.
+type MaintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// MaintenanceResponse defines the JSON response for the maintenance endpoint.
+type MaintenanceResponse struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// setMaintenance turns maintenance mode on or off and logs the change,
+// naming what caused it. Taking s.mu means that once it returns, no write
+// is halfway through and none will start until maintenance mode is off.
+func (s *Server) setMaintenance(on bool, source string) {
+	s.mu.Lock()
+	changed := s.maintenance != on
+	s.maintenance = on
+	s.mu.Unlock()
+
+	switch {
+	case !changed:
+	case on:
+		logInfo("Maintenance mode on (%s): writes are refused", source)
+	default:
+		logInfo("Maintenance mode off (%s): writes are allowed again", source)
+	}
+}
+
+// inMaintenance responds 503 Service Unavailable to a write made while
+// maintenance mode is on. Reads are unaffected. Caller must hold s.mu.
+func (s *Server) inMaintenance(w http.ResponseWriter) bool {
+	if !s.maintenance {
+		return false
+	}
+	w.Header().Set("Retry-After", "60")
+	writeError(w, http.StatusServiceUnavailable, errCodeMaintenance, "Maintenance mode: writes are temporarily disabled")
+	return true
+}
+
+// handleMaintenance reports (GET) or sets (POST) maintenance mode, in which
+// every write is refused with 503 while reads keep working, e.g. during a
+// backup or migration. SIGUSR1 toggles it too. /admin/restore still works.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req MaintenanceRequest
+		if !s.decodeBody(w, r, &req) {
+			return
+		}
+		s.setMaintenance(req.Enabled, "/admin/maintenance")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.rlock(r)
+	on := s.maintenance
+	s.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MaintenanceResponse{Maintenance: on})
+}
+
+// RestoreChange reports how the restore changed the balance of one account.
+type RestoreChange struct {
+	User       string `json:"user"`
+	Account    string `json:"account"`
+	OldBalance int32  `json:"old_balance"`
+	NewBalance int32  `json:"new_balance"`
+}
+
+// RestoreResponse defines the JSON response for the restore endpoint: the
+// number of accounts restored and the balances that changed, by user and
+// account name.
+type RestoreResponse struct {
+	Accounts int             `json:"accounts"`
+	Changes  []RestoreChange `json:"changes"`
+}
+
+// handleRestore replaces the whole state with an uploaded data file, as
+// downloaded from /admin/backup or copied from DBFile. Legacy formats are
+// accepted (see parseData). The file is fully parsed and checked before
+// anything is touched, and if saving it fails the previous state is kept.
+// Each account whose balance changes gets a RESTORE transaction recording
+// the new balance; the response lists old and new balances. Undo history
+// is dropped, as it refers to the replaced state.
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRestoreBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "Data file too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, "Invalid body")
+		return
+	}
+
+	s.usersMu.RLock()
+	owner := ""
+	if len(s.userOrder) > 0 {
+		owner = s.userOrder[0]
+	}
+	s.usersMu.RUnlock()
+	df, _, err := parseData(data, owner)
+	if err == nil {
+		err = checkDataFile(df)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	old := dataFile{
+		Accounts:   s.accounts,
+		Recurring:  s.recurring,
+		Categories: s.categoryList(),
+		Seq:        s.seq,
+		Baselines:  s.baselines,
+	}
+	// Sequence numbers already in the transaction log must not be reissued
+	df.Seq = max(df.Seq, s.seq)
+	s.setState(df)
+	if err := s.saveData(); err != nil {
+		s.setState(&old)
+		logRequestError(r, "Error saving restored data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	clear(s.undo)
+
+	type accountKey struct{ user, name string }
+	oldBalances := make(map[accountKey]int32)
+	for user, accts := range old.Accounts {
+		for name, acct := range accts {
+			oldBalances[accountKey{user, name}] = acct.Balance
+		}
+	}
+	resp := RestoreResponse{Changes: []RestoreChange{}}
+	for user, accts := range s.accounts {
+		for name, acct := range accts {
+			resp.Accounts++
+			key := accountKey{user, name}
+			if prev, ok := oldBalances[key]; !ok || prev != acct.Balance {
+				resp.Changes = append(resp.Changes, RestoreChange{user, name, prev, acct.Balance})
+			}
+			delete(oldBalances, key)
+		}
+	}
+	// Accounts missing from the restored file now read as zero
+	for key, prev := range oldBalances {
+		if prev != 0 {
+			resp.Changes = append(resp.Changes, RestoreChange{key.user, key.name, prev, 0})
+		}
+	}
+	sort.Slice(resp.Changes, func(i, j int) bool {
+		a, b := resp.Changes[i], resp.Changes[j]
+		return a.User < b.User || (a.User == b.User && a.Account < b.Account)
+	})
+	for _, c := range resp.Changes {
+		s.logTransaction(c.User, c.Account, "RESTORE", c.NewBalance, "")
+	}
+	logInfo("Restored %s from an upload of %d bytes: %d account(s), %d balance(s) changed",
+		s.cfg.DBFile, len(data), resp.Accounts, len(resp.Changes))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// checkDataFile rejects a parsed data file with entries the handlers could
+// not work with, such as null accounts or invalid names.
+func checkDataFile(df *dataFile) error {
+	for user, accts := range df.Accounts {
+		for name, acct := range accts {
+			if acct == nil {
+				return fmt.Errorf("account %q of user %q is null", name, user)
+			}
+			if !validAccountName(name) {
+				return fmt.Errorf("invalid account name %q", name)
+			}
+		}
+	}
+	for _, rule := range df.Recurring {
+		if rule == nil {
+			return errors.New("null recurring rule")
+		}
+	}
+	for _, b := range df.Baselines {
+		if b == nil {
+			return errors.New("null baseline")
+		}
+	}
+	for _, c := range df.Categories {
+		if !validName(c, maxCategoryNameLen) {
+			return fmt.Errorf("invalid category %q", c)
+		}
+	}
+	return nil
+}
+
+// handleWhoami tells the client which user its token authenticates as, along
+// with that user's default balance and account names. It has no side effects.
+func (s *Server) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requestUser(r)
+
+	s.rlock(r)
+	acct := s.peekAccount(user, defaultAccountName)
+	names := []string{}
+	for name := range s.accounts[user] {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+
+	s.usersMu.RLock()
+	displayName := s.displayNames[user]
+	s.usersMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WhoamiResponse{
+		User:     user,
+		Name:     displayName,
+		Balance:  acct.Balance,
+		Budget:   acct.Budget,
+		Currency: s.currencyOf(&acct),
+		Accounts: names,
+		Role:     requestRole(r),
+	})
+}
+
+// AccountSummary describes one account in the /accounts response: its name
+// and the account as /accounts/{name}/get returns it.
+type AccountSummary struct {
+	Name string `json:"name"`
+	GetResponse
+}
+
+// handleAccounts lists all of the user's accounts, sorted by name, for
+// dashboards that would otherwise call /get once per account. The default
+// account is always included, reading as zero until it is written, as on
+// /get. All accounts are read under one read lock so the balances are
+// consistent with each other.
+func (s *Server) handleAccounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requestUser(r)
+
+	s.rlock(r)
+	names := []string{defaultAccountName}
+	for name := range s.accounts[user] {
+		if name != defaultAccountName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	list := make([]AccountSummary, 0, len(names))
+	for _, name := range names {
+		acct := s.peekAccount(user, name)
+		list = append(list, AccountSummary{Name: name, GetResponse: s.accountResponse(user, name, &acct)})
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleSet sets the balance to a specific absolute value.
+func (s *Server) handleSet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SetRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	amount := int32(req.Amount)
+
+	if amount > s.cfg.MaxBalance || amount < s.lowestBalance() {
+		writeError(w, http.StatusBadRequest, errCodeAmountExceedsLimit, "Amount exceeds limit")
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Balance = amount
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log the SET action
+	s.logTransaction(user, name, "SET", amount, "")
+	s.metrics.sets.Add(1)
+	s.stats.add(&s.stats.sets, 1)
+	s.pushUndo(user, name, before, acct)
+	s.checkThreshold(user, name, before, acct)
+
+	s.writeBalance(w, r, acct)
+}
+
+// addInt32 returns a+b, with ok false if the sum does not fit in an int32.
+func addInt32(a, b int32) (sum int32, ok bool) {
+	sum = a + b
+	return sum, (b >= 0) == (sum >= a)
+}
+
+// subInt32 returns a-b, with ok false if the difference does not fit in an int32.
+func subInt32(a, b int32) (diff int32, ok bool) {
+	diff = a - b
+	return diff, (b >= 0) == (diff <= a)
+}
+
+// writeOverflow rejects a request whose arithmetic would wrap around.
+func writeOverflow(w http.ResponseWriter) {
+	writeError(w, http.StatusBadRequest, errCodeBalanceOverflow, "Balance would overflow")
+}
+
+// spendAmount converts the Amount of a SpendRequest to the amount taken from
+// the balance, which is how the handlers and their checks see it whatever
+// Config.SpendSign is. ok is false for the one amount that has no such
+// counterpart, math.MinInt32 under spendSignInflow, as negating it wraps.
+// The transaction log records SPEND amounts in the same convention, with the
+// rows logged under spendSignInflow marked so that they read back the same
+// as the others (see writeTransaction).
+func (s *Server) spendAmount(amount int32) (spend int32, ok bool) {
+	if s.cfg.SpendSign == spendSignInflow {
+		if amount == math.MinInt32 {
+			return 0, false
+		}
+		return -amount, true
+	}
+	return amount, true
+}
+
+// spendAmountError is the message for a /spend amount of the wrong sign.
+func (s *Server) spendAmountError() string {
+	if s.cfg.SpendSign == spendSignInflow {
+		return "Amount must be negative"
+	}
+	return "Amount must be positive"
+}
+
+// handleSpend subtracts a positive amount from the balance (see spendAmount).
+// With ?dry_run=true it only validates the spend and returns the balance it
+// would produce as JSON, without saving or logging anything.
+// Amounts that would raise the balance (credits) are rejected unless
+// ?allow_negative=true is given for clients predating /credit. Spends over
+// Config.ConfirmAbove need a second request carrying the token from the
+// first (see requestConfirmation). /spend/batch does not ask for one.
+func (s *Server) handleSpend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SpendRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	amount, ok := s.spendAmount(int32(req.Amount))
+	if !ok {
+		writeError(w, http.StatusBadRequest, errCodeTransactionTooLarge, "Transaction too large")
+		return
+	}
+
+	req.Category = strings.ToLower(strings.TrimSpace(req.Category))
+	if req.Category != "" && !s.knownCategory(req.Category) {
+		writeError(w, http.StatusBadRequest, errCodeUnknownCategory, "Unknown category")
+		return
+	}
+	req.Memo = cleanMemo(req.Memo)
+	if len(req.Memo) > maxMemoLen {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Memo too long")
+		return
+	}
+
+	// ?dry_run=true validates and previews the result without committing it
+	dryRun, err := boolParam(r, "dry_run")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid dry_run value")
+		return
+	}
+	allowNegative, err := boolParam(r, "allow_negative")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid allow_negative value")
+		return
+	}
+	if amount <= 0 && !allowNegative {
+		writeError(w, http.StatusBadRequest, errCodeInvalidAmount, s.spendAmountError()+"; use /credit to add money")
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	// Overflow/Data Safety Check
+	// Prevent massive transactions that could overflow int32 or are unreasonable.
+	if amount > s.cfg.MaxTransaction || amount < -s.cfg.MaxTransaction { // ~£1m at the default scale
+		writeError(w, http.StatusBadRequest, errCodeTransactionTooLarge,
+			fmt.Sprintf("Transaction too large: the limit is %d", s.cfg.MaxTransaction))
+		return
+	}
+
+	// Daily Limit Check: spends over the last 24 hours, across all of the
+	// user's accounts, must stay within the configured total.
+	if s.cfg.DailySpendLimit > 0 && amount > 0 {
+		cutoff := s.now().Add(-24 * time.Hour).Format(transactionTimeLayout)
+		spent, err := s.spentSince(user, cutoff)
+		if err != nil {
+			logRequestError(r, "Error reading transactions: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if spent+int64(amount) > s.cfg.DailySpendLimit {
+			writeError(w, http.StatusBadRequest, errCodeDailyLimitExceeded,
+				fmt.Sprintf("Daily spend limit exceeded: %d of %d already spent in the last 24 hours",
+					spent, s.cfg.DailySpendLimit))
+			return
+		}
+	}
+
+	// Work on a copy until every check has passed, so a dry run (or a
+	// rejected spend) never creates or touches the stored account.
+	current := s.peekAccount(user, name)
+	if err := s.checkAccountLimit(user, name); err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	balance, ok := subInt32(current.Balance, amount)
+	if !ok {
+		writeOverflow(w)
+		return
+	}
+	// Floor Check: reject spends that would leave the balance below the
+	// configured minimum, unless overdraft or debt mode has been enabled.
+	if s.belowFloor(balance) {
+		writeError(w, http.StatusBadRequest, errCodeInsufficientBalance, "Insufficient balance")
+		return
+	}
+	// A negative spend raises the balance, which must stay within the cap;
+	// in debt mode the cap also applies below zero
+	if balance > s.cfg.MaxBalance || balance < s.lowestBalance() {
+		writeError(w, http.StatusBadRequest, errCodeAmountExceedsLimit, "Balance would exceed limit")
+		return
+	}
+
+	// Category Budget Check: a spend taking its category over budget is
+	// refused, or with BUDGET_CATEGORY_LIMIT=warn applied and flagged
+	if limit, ok := current.CategoryBudgets[req.Category]; ok && amount > 0 {
+		spent, err := s.categorySpent(user, name, s.now())
+		if err != nil {
+			logRequestError(r, "Error reading transactions: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if spent[req.Category]+int64(amount) > int64(limit) {
+			if s.cfg.CategoryLimit == categoryLimitReject {
+				writeError(w, http.StatusBadRequest, errCodeCategoryOverBudget,
+					fmt.Sprintf("Category budget exceeded: %d of the %d for %s already spent",
+						spent[req.Category], limit, req.Category))
+				return
+			}
+			w.Header().Set("X-Category-Over-Budget", req.Category)
+		}
+	}
+
+	if dryRun {
+		preview := current
+		preview.Balance = balance
+		w.Header().Set("X-Dry-Run", "true")
+		s.writeAccountJSON(w, r, &preview)
+		return
+	}
+
+	// Large spends only go through once the client confirms them
+	if s.cfg.ConfirmAbove > 0 && amount > s.cfg.ConfirmAbove {
+		spend := pendingSpend{user: user, account: name, amount: amount, category: req.Category}
+		if !s.confirmSpend(r.Header.Get("X-Confirm-Token"), spend) {
+			preview := current
+			preview.Balance = balance
+			s.requestConfirmation(w, r, spend, &preview)
+			return
+		}
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Balance = balance
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log the SPEND action
+	s.logTransactionMemo(user, name, "SPEND", amount, req.Category, req.Memo)
+	s.metrics.spends.Add(1)
+	s.stats.add(&s.stats.spends, 1)
+	s.stats.add(&s.stats.spent, int64(amount))
+	s.pushUndo(user, name, before, acct)
+	s.checkThreshold(user, name, before, acct)
+
+	s.writeBalance(w, r, acct)
+}
+
+// handleSpendBatch applies a JSON array of SpendRequest items, e.g. the
+// lines of a receipt, as one change: every item is validated as /spend
+// would, against the balance left by the items before it, and either all of
+// them are saved and logged as separate SPEND transactions or, if any is
+// invalid, none is and the response lists what was wrong with each.
+// Negative amounts are not accepted.
+func (s *Server) handleSpendBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var items []SpendRequest
+	if !s.decodeBody(w, r, &items) {
+		return
+	}
+	if len(items) == 0 || len(items) > maxBatchItems {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody,
+			fmt.Sprintf("A batch must have between 1 and %d items", maxBatchItems))
+		return
+	}
+
+	statuses := make([]BatchItemStatus, len(items))
+	invalid := func(i int, code, message string) {
+		statuses[i] = BatchItemStatus{Status: batchItemInvalid, Error: code, Message: message}
+	}
+	for i := range items {
+		item := &items[i]
+		amount, ok := s.spendAmount(int32(item.Amount))
+		item.Amount = Money(amount)
+		item.Category = strings.ToLower(strings.TrimSpace(item.Category))
+		item.Memo = cleanMemo(item.Memo)
+		switch {
+		case !ok:
+			invalid(i, errCodeTransactionTooLarge, fmt.Sprintf("Transaction too large: the limit is %d", s.cfg.MaxTransaction))
+		case amount <= 0:
+			invalid(i, errCodeInvalidAmount, s.spendAmountError())
+		case amount > s.cfg.MaxTransaction:
+			invalid(i, errCodeTransactionTooLarge, fmt.Sprintf("Transaction too large: the limit is %d", s.cfg.MaxTransaction))
+		case item.Category != "" && !s.knownCategory(item.Category):
+			invalid(i, errCodeUnknownCategory, "Unknown category")
+		case len(item.Memo) > maxMemoLen:
+			invalid(i, errCodeInvalidParameter, "Memo too long")
+		default:
+			statuses[i].Status = batchItemValid
+		}
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	current := s.peekAccount(user, name)
+	if err := s.checkAccountLimit(user, name); err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var spent int64
+	if s.cfg.DailySpendLimit > 0 {
+		cutoff := s.now().Add(-24 * time.Hour).Format(transactionTimeLayout)
+		var err error
+		if spent, err = s.spentSince(user, cutoff); err != nil {
+			logRequestError(r, "Error reading transactions: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	categorySpent := make(map[string]int64)
+	if len(current.CategoryBudgets) > 0 {
+		var err error
+		if categorySpent, err = s.categorySpent(user, name, s.now()); err != nil {
+			logRequestError(r, "Error reading transactions: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Run the valid items against the balance in order, as if they were
+	// separate spends
+	balance := current.Balance
+	var overBudget []string
+	for i, item := range items {
+		if statuses[i].Status != batchItemValid {
+			continue
+		}
+		next, ok := subInt32(balance, int32(item.Amount))
+		limit, limited := current.CategoryBudgets[item.Category]
+		over := limited && categorySpent[item.Category]+int64(item.Amount) > int64(limit)
+		switch {
+		case !ok:
+			invalid(i, errCodeBalanceOverflow, "Balance would overflow")
+		case s.belowFloor(next):
+			invalid(i, errCodeInsufficientBalance, "Insufficient balance")
+		case next < s.lowestBalance():
+			invalid(i, errCodeAmountExceedsLimit, "Balance would exceed limit")
+		case s.cfg.DailySpendLimit > 0 && spent+int64(item.Amount) > s.cfg.DailySpendLimit:
+			invalid(i, errCodeDailyLimitExceeded, "Daily spend limit exceeded")
+		case over && s.cfg.CategoryLimit == categoryLimitReject:
+			invalid(i, errCodeCategoryOverBudget, "Category budget exceeded for "+item.Category)
+		default:
+			balance = next
+			spent += int64(item.Amount)
+			categorySpent[item.Category] += int64(item.Amount)
+			if over && !slices.Contains(overBudget, item.Category) {
+				overBudget = append(overBudget, item.Category)
+			}
+		}
+	}
+	if len(overBudget) > 0 {
+		w.Header().Set("X-Category-Over-Budget", strings.Join(overBudget, ","))
+	}
+	for i, st := range statuses {
+		if st.Status == batchItemInvalid {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(SpendBatchError{
+				ErrorResponse: ErrorResponse{Error: st.Error, Message: fmt.Sprintf("Item %d: %s", i, st.Message)},
+				Items:         statuses,
+			})
+			return
+		}
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Balance = balance
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	for i, item := range items {
+		s.logTransactionMemo(user, name, "SPEND", int32(item.Amount), item.Category, item.Memo)
+		statuses[i].Status = batchItemApplied
+		s.stats.add(&s.stats.spent, int64(item.Amount))
+	}
+	s.metrics.spends.Add(int64(len(items)))
+	s.stats.add(&s.stats.spends, int64(len(items)))
+	s.pushUndo(user, name, before, acct)
+	s.checkThreshold(user, name, before, acct)
+
+	w.Header().Set("ETag", accountETag(acct))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SpendBatchResponse{
+		GetResponse: s.accountResponse(user, name, acct),
+		Items:       statuses,
+	})
+}
+
+// handleCredit adds a positive amount to the balance, e.g. a refund or extra
+// income, and logs it as a CREDIT.
+func (s *Server) handleCredit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CreditRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	amount := int32(req.Amount)
+
+	if amount <= 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidAmount, "Amount must be positive")
+		return
+	}
+	if amount > s.cfg.MaxTransaction {
+		writeError(w, http.StatusBadRequest, errCodeTransactionTooLarge, "Transaction too large")
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	balance, ok := addInt32(s.peekAccount(user, name).Balance, amount)
+	if !ok {
+		writeOverflow(w)
+		return
+	}
+	if balance > s.cfg.MaxBalance {
+		writeError(w, http.StatusBadRequest, errCodeAmountExceedsLimit, "Balance would exceed limit")
+		return
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Balance = balance
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log the CREDIT action
+	s.logTransaction(user, name, "CREDIT", amount, "")
+	s.metrics.credits.Add(1)
+	s.pushUndo(user, name, before, acct)
+
+	s.writeBalance(w, r, acct)
+}
+
+// handleAdjust adds a signed delta to the balance, logged as an ADJUST.
+// A negative delta is subject to the same floor check as a spend; either
+// direction is limited to MaxTransaction and must keep the balance within
+// MaxBalance. Responds with the updated account as JSON.
+func (s *Server) handleAdjust(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AdjustRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	delta := int32(req.Delta)
+
+	if delta == 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidAmount, "Delta must not be zero")
+		return
+	}
+	if delta > s.cfg.MaxTransaction || delta < -s.cfg.MaxTransaction {
+		writeError(w, http.StatusBadRequest, errCodeTransactionTooLarge, "Transaction too large")
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	result, ok := addInt32(s.peekAccount(user, name).Balance, delta)
+	if !ok {
+		writeOverflow(w)
+		return
+	}
+	if delta < 0 && s.belowFloor(result) {
+		writeError(w, http.StatusBadRequest, errCodeInsufficientBalance, "Insufficient balance")
+		return
+	}
+	if result > s.cfg.MaxBalance || result < s.lowestBalance() {
+		writeError(w, http.StatusBadRequest, errCodeAmountExceedsLimit, "Balance would exceed limit")
+		return
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Balance = result
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log the ADJUST action with the signed delta
+	s.logTransaction(user, name, "ADJUST", delta, "")
+	s.pushUndo(user, name, before, acct)
+	s.checkThreshold(user, name, before, acct)
+
+	s.writeAccountJSON(w, r, acct)
+}
+
+// handleRefund reverses a single earlier SPEND or ADJUST of the calling
+// user's account, identified by the seq of its log entry, e.g. for a
+// purchase that was refunded. Unlike /undo it can reach past later
+// transactions. The reversal is logged as a REFUND of the inverse amount
+// with the original's category and a refundMemo naming its seq, which is
+// also how a second refund of the same transaction is refused until the
+// refund is undone. Responds with the updated account as JSON.
+func (s *Server) handleRefund(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefundRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	if req.Seq <= 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "seq must be positive")
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	orig, found, refunded, err := s.refundTarget(user, name, req.Seq)
+	if err != nil {
+		logRequestError(r, "Error reading transaction log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !found || !orig.ownedBy(user, name) {
+		writeError(w, http.StatusBadRequest, errCodeNotRefundable, "No such transaction")
+		return
+	}
+	if (orig.Action != "SPEND" && orig.Action != "ADJUST") || orig.Amount == 0 {
+		writeError(w, http.StatusBadRequest, errCodeNotRefundable, "Only spends and adjustments can be refunded")
+		return
+	}
+	if refunded {
+		writeError(w, http.StatusConflict, errCodeAlreadyRefunded, "Transaction was already refunded")
+		return
+	}
+
+	// The change to the balance that undoes the original
+	delta := orig.Amount
+	if orig.Action == "ADJUST" {
+		delta = -orig.Amount
+	}
+	result, ok := addInt32(s.peekAccount(user, name).Balance, delta)
+	if !ok {
+		writeOverflow(w)
+		return
+	}
+	if delta < 0 && s.belowFloor(result) {
+		writeError(w, http.StatusBadRequest, errCodeInsufficientBalance, "Insufficient balance")
+		return
+	}
+	if result > s.cfg.MaxBalance || result < s.lowestBalance() {
+		writeError(w, http.StatusBadRequest, errCodeAmountExceedsLimit, "Balance would exceed limit")
+		return
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Balance = result
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log the REFUND with the change it made to the balance
+	s.logTransactionMemo(user, name, "REFUND", delta, orig.Category, refundMemo(orig.Seq))
+	s.pushUndoEntry(user, name, undoEntry{balanceDelta: delta, refunds: orig.Seq})
+	s.checkThreshold(user, name, before, acct)
+
+	s.writeAccountJSON(w, r, acct)
+}
+
+// refundTarget looks up the transaction logged with the given seq and reports
+// whether the user's named account has a REFUND of it that was not undone
+// since. Transactions pruned from the log are not found. Caller must hold
+// s.mu, so that no refund is logged between the check and its own.
+func (s *Server) refundTarget(user, name string, seq int64) (orig Transaction, found, refunded bool, err error) {
+	refunds := 0
+	err = s.eachTransaction(func(t Transaction) {
+		if t.Seq == seq {
+			orig, found = t, true
+		}
+		if target, n := refundChange(t); target == seq && t.ownedBy(user, name) {
+			refunds += n
+		}
+	})
+	return orig, found, refunds > 0, err
+}
+
+// refundMemo is the memo of a REFUND transaction, naming the seq of the
+// transaction it reversed.
+func refundMemo(seq int64) string {
+	return "refunds=" + strconv.FormatInt(seq, 10)
+}
+
+// unrefundMemo is the memo of the UNDO of a REFUND, naming the seq of the
+// transaction it reopened.
+func unrefundMemo(seq int64) string {
+	return "unrefunds=" + strconv.FormatInt(seq, 10)
+}
+
+// refundChange reports the seq of the transaction that t refunded (n = 1)
+// or, for the UNDO of a refund, reopened (n = -1). It returns 0, 0 for
+// other transactions.
+func refundChange(t Transaction) (seq int64, n int) {
+	prefix, n := "", 0
+	switch t.Action {
+	case "REFUND":
+		prefix, n = "refunds=", 1
+	case "UNDO":
+		prefix, n = "unrefunds=", -1
+	default:
+		return 0, 0
+	}
+	v, ok := strings.CutPrefix(t.Memo, prefix)
+	if !ok {
+		return 0, 0
+	}
+	seq, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seq <= 0 {
+		return 0, 0
+	}
+	return seq, n
+}
+
+// boolParam parses the named boolean query parameter; absent means false.
+func boolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// handleSetBudget sets the budget and updates the balance according to
+// ?mode=:
+//   - adjust_balance (default): the balance moves by the change in budget.
+//   - preserve_spent: the amount spent so far (budget - balance) is kept and
+//     the balance becomes the new budget minus it.
+//
+// With "rollover": true in the body (and no mode) it instead starts a new
+// period: any remaining positive balance is added to the new budget, the
+// balance is set to the result, and the amount carried over is logged as a
+// ROLLOVER before the BUDGET_CHANGE. An overspent balance is not carried.
+//
+// It returns the account, the applied mode and the amount spent as JSON.
+func (s *Server) handleSetBudget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	var req SetBudgetRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	budget := int32(req.Budget)
+	switch {
+	case req.Rollover && mode != "":
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "mode cannot be combined with rollover")
+		return
+	case req.Rollover:
+		mode = budgetModeRollover
+	case mode == "":
+		mode = budgetModeAdjustBalance
+	case mode != budgetModeAdjustBalance && mode != budgetModePreserveSpent:
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid mode value")
+		return
+	}
+
+	// Basic validation: Budget must be positive (or, in debt mode, a debt
+	// within the cap) and reasonable
+	if budget < s.lowestBudget() || budget > s.cfg.MaxBalance {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBudget, "Invalid budget amount")
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	current := s.peekAccount(user, name)
+	var balance, carried int32
+	var ok bool
+	switch mode {
+	case budgetModeRollover:
+		carried = max(current.Balance, 0)
+		if budget, ok = addInt32(budget, carried); ok && budget > s.cfg.MaxBalance {
+			writeError(w, http.StatusBadRequest, errCodeAmountExceedsLimit,
+				fmt.Sprintf("Budget plus the %d rolled over would exceed the limit of %d", carried, s.cfg.MaxBalance))
+			return
+		}
+		balance = budget
+	case budgetModePreserveSpent:
+		var spent int32
+		if spent, ok = subInt32(current.Budget, current.Balance); ok {
+			balance, ok = subInt32(budget, spent)
+		}
+	default:
+		var diff int32
+		if diff, ok = subInt32(budget, current.Budget); ok {
+			balance, ok = addInt32(current.Balance, diff)
+		}
+	}
+	if !ok {
+		writeOverflow(w)
+		return
+	}
+	if balance > s.cfg.MaxBalance || balance < s.lowestBalance() {
+		writeError(w, http.StatusBadRequest, errCodeAmountExceedsLimit, "Balance would exceed limit")
+		return
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Budget = budget
+	acct.Balance = balance
+
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log the ROLLOVER, if any, and the BUDGET_CHANGE action
+	if mode == budgetModeRollover {
+		s.logTransaction(user, name, "ROLLOVER", carried, "")
+	}
+	s.logTransaction(user, name, "BUDGET_CHANGE", budget, "")
+	s.stats.add(&s.stats.budgetChanges, 1)
+	s.pushUndo(user, name, before, acct)
+	s.checkThreshold(user, name, before, acct)
+
+	w.Header().Set("ETag", accountETag(acct))
+	w.Header().Set("X-Response-Format", "json")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SetBudgetResponse{
+		GetResponse: s.accountResponse(user, name, acct),
+		Mode:        mode,
+		BudgetUsed:  int64(acct.Budget) - int64(acct.Balance),
+		RolledOver:  carried,
+	})
+}
+
+// handleReset starts a new period by setting the balance back to the full
+// budget. It takes no parameters and returns the new balance and budget as JSON.
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Balance = acct.Budget
+
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log the RESET action with the resulting balance
+	s.logTransaction(user, name, "RESET", acct.Balance, "")
+	s.pushUndo(user, name, before, acct)
+
+	s.writeAccountJSON(w, r, acct)
+}
+
+// handleInit sets both the balance and the budget, e.g. at the start of a
+// period, so that nobody can read the account between the two changes as
+// they could between /set_budget and /set. Both values are checked before
+// anything changes, and the result is logged as a single INIT transaction
+// whose amount is the balance, with the budget in the memo column (see
+// initMemo). It returns the account as JSON.
+func (s *Server) handleInit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req InitRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	balance, budget := int32(req.Balance), int32(req.Budget)
+
+	if budget < s.lowestBudget() || budget > s.cfg.MaxBalance {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBudget, "Invalid budget amount")
+		return
+	}
+	if balance > s.cfg.MaxBalance || balance < s.lowestBalance() {
+		writeError(w, http.StatusBadRequest, errCodeAmountExceedsLimit, "Balance exceeds limit")
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	_, existed := s.accounts[user][name]
+	acct, err := s.account(user, name)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	before := *acct
+	acct.Version++
+	acct.Budget = budget
+	acct.Balance = balance
+
+	if err := s.saveData(); err != nil {
+		*acct = before
+		if !existed {
+			delete(s.accounts[user], name)
+		}
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	s.logTransactionMemo(user, name, "INIT", balance, "", initMemo(budget))
+	s.metrics.sets.Add(1)
+	s.stats.add(&s.stats.sets, 1)
+	s.stats.add(&s.stats.budgetChanges, 1)
+	s.pushUndo(user, name, before, acct)
+	s.checkThreshold(user, name, before, acct)
+
+	s.writeAccountJSON(w, r, acct)
+}
+
+// initMemo is the memo of an INIT transaction, recording the budget that
+// was set along with the balance. parseInitMemo reverses it.
+func initMemo(budget int32) string {
+	return "budget=" + strconv.FormatInt(int64(budget), 10)
+}
+
+// parseInitMemo returns the budget recorded by initMemo.
+func parseInitMemo(memo string) (int32, error) {
+	v, ok := strings.CutPrefix(memo, "budget=")
+	if !ok {
+		return 0, errors.New("missing budget")
+	}
+	budget, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return 0, errors.New("invalid budget")
+	}
+	return int32(budget), nil
+}
+
+// handleRecurring manages the caller's recurring transaction rules.
+//   - GET lists the rules.
+//   - POST creates a rule from a RecurringRequest body.
+//   - DELETE ?id=N removes a rule.
+func (s *Server) handleRecurring(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		s.rlock(r)
+		defer s.mu.RUnlock()
+
+		rules := []RecurringRule{}
+		for _, rule := range s.recurring {
+			if rule.User == user {
+				rules = append(rules, *rule)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+
+	case http.MethodPost:
+		var req RecurringRequest
+		if !s.decodeBody(w, r, &req) {
+			return
+		}
+		req.Category = strings.ToLower(strings.TrimSpace(req.Category))
+		req.Description = strings.TrimSpace(req.Description)
+		if int32(req.Amount) <= 0 || int32(req.Amount) > s.cfg.MaxTransaction {
+			writeError(w, http.StatusBadRequest, errCodeTransactionTooLarge, "Amount must be positive and within the transaction limit")
+			return
+		}
+		if req.Category != "" && !s.knownCategory(req.Category) {
+			writeError(w, http.StatusBadRequest, errCodeUnknownCategory, "Unknown category")
+			return
+		}
+		if req.Day < 1 || req.Day > 31 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Day must be between 1 and 31")
+			return
+		}
+		if len(req.Description) > maxDescriptionLen {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Description too long")
+			return
+		}
+
+		s.lock(r)
+		defer s.mu.Unlock()
+
+		if s.inMaintenance(w) {
+			return
+		}
+
+		if len(s.recurring) >= maxRecurringRules {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Too many recurring rules")
+			return
+		}
+
+		id := 1
+		for _, rule := range s.recurring {
+			id = max(id, rule.ID+1)
+		}
+		rule := &RecurringRule{
+			ID:          id,
+			User:        user,
+			Amount:      int32(req.Amount),
+			Category:    req.Category,
+			Day:         req.Day,
+			Description: req.Description,
+			NextDue:     firstOccurrence(s.now(), req.Day).Format("2006-01-02"),
+		}
+		s.recurring = append(s.recurring, rule)
+
+		if err := s.saveData(); err != nil {
+			s.recurring = s.recurring[:len(s.recurring)-1]
+			logRequestError(r, "Error saving data: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid id")
+			return
+		}
+
+		s.lock(r)
+		defer s.mu.Unlock()
+
+		if s.inMaintenance(w) {
+			return
+		}
+
+		for i, rule := range s.recurring {
+			if rule.ID == id && rule.User == user {
+				prev := s.recurring
+				s.recurring = slices.Delete(slices.Clone(prev), i, i+1)
+				if err := s.saveData(); err != nil {
+					s.recurring = prev
+					logRequestError(r, "Error saving data: %v", err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "Rule not found", http.StatusNotFound)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// CategoryRequest defines the JSON payload for adding a category.
+type CategoryRequest struct {
+	Name string `json:"name"`
+}
+
+// CategoriesResponse defines the JSON response for the categories endpoint.
+// InHistory is set when a removed category still appears in logged
+// transactions, which keep it as history is never rewritten.
+type CategoriesResponse struct {
+	Categories []string `json:"categories"`
+	InHistory  bool     `json:"in_history,omitempty"`
+}
+
+// knownCategory reports whether c is one of the allowed spend categories.
+func (s *Server) knownCategory(c string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.categories[c]
+}
+
+// categoryList returns the allowed categories, sorted. Caller must hold s.mu.
+func (s *Server) categoryList() []string {
+	list := make([]string, 0, len(s.categories))
+	for c := range s.categories {
+		list = append(list, c)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// handleCategories manages the categories spends may be tagged with. The
+// list is shared by all users and persisted in the data file.
+//   - GET lists the categories.
+//   - POST adds the category named in a CategoryRequest body.
+//   - DELETE ?name=C removes a category.
+//
+// Each returns the resulting list as CategoriesResponse JSON.
+func (s *Server) handleCategories(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.rlock(r)
+		defer s.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CategoriesResponse{Categories: s.categoryList()})
+
+	case http.MethodPost:
+		var req CategoryRequest
+		if !s.decodeBody(w, r, &req) {
+			return
+		}
+		name := strings.ToLower(strings.TrimSpace(req.Name))
+		if !validName(name, maxCategoryNameLen) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter,
+				fmt.Sprintf("Category must be 1 to %d characters from a-z, 0-9, _ and -", maxCategoryNameLen))
+			return
+		}
+
+		s.lock(r)
+		defer s.mu.Unlock()
+
+		if s.inMaintenance(w) {
+			return
+		}
+
+		if s.categories[name] {
+			writeError(w, http.StatusConflict, errCodeDuplicateCategory, "Category already exists")
+			return
+		}
+		if len(s.categories) >= maxCategories {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Too many categories")
+			return
+		}
+		s.categories[name] = true
+		if err := s.saveData(); err != nil {
+			delete(s.categories, name)
+			logRequestError(r, "Error saving data: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CategoriesResponse{Categories: s.categoryList()})
+
+	case http.MethodDelete:
+		name := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("name")))
+
+		s.lock(r)
+		defer s.mu.Unlock()
+
+		if s.inMaintenance(w) {
+			return
+		}
+
+		if !s.categories[name] {
+			writeError(w, http.StatusNotFound, errCodeUnknownCategory, "Unknown category")
+			return
+		}
+		delete(s.categories, name)
+		if err := s.saveData(); err != nil {
+			s.categories[name] = true
+			logRequestError(r, "Error saving data: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		resp := CategoriesResponse{Categories: s.categoryList()}
+		err := s.eachTransaction(func(t Transaction) {
+			if t.Category == name {
+				resp.InHistory = true
+			}
+		})
+		if err != nil {
+			logRequestError(r, "Error reading transaction log: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// BaselineRequest defines the JSON payload for saving a baseline.
+type BaselineRequest struct {
+	Name string `json:"name"`
+}
+
+// findBaseline returns the index in s.baselines of the user's baseline of
+// the given account and name, or -1. Caller must hold s.mu (read or write).
+func (s *Server) findBaseline(user, account, name string) int {
+	for i, b := range s.baselines {
+		if b.User == user && b.Account == account && b.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleBaseline manages the caller's baselines of an account. GET lists
+// them (or returns the one named by ?name=), POST snapshots the account's
+// current balance and budget under a name, replacing any baseline of that
+// name, and DELETE ?name= removes one.
+func (s *Server) handleBaseline(w http.ResponseWriter, r *http.Request) {
+	user, account := requestUser(r), requestAccount(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		name := r.URL.Query().Get("name")
+
+		s.rlock(r)
+		defer s.mu.RUnlock()
+
+		if name != "" {
+			i := s.findBaseline(user, account, name)
+			if i < 0 {
+				http.Error(w, "Baseline not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s.baselines[i])
+			return
+		}
+		list := []Baseline{}
+		for _, b := range s.baselines {
+			if b.User == user && b.Account == account {
+				list = append(list, *b)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case http.MethodPost:
+		var req BaselineRequest
+		if !s.decodeBody(w, r, &req) {
+			return
+		}
+		name := strings.ToLower(strings.TrimSpace(req.Name))
+		if !validName(name, maxBaselineNameLen) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter,
+				fmt.Sprintf("Name must be 1 to %d characters from a-z, 0-9, _ and -", maxBaselineNameLen))
+			return
+		}
+
+		s.lock(r)
+		defer s.mu.Unlock()
+
+		if s.inMaintenance(w) {
+			return
+		}
+
+		acct := s.peekAccount(user, account)
+		b := &Baseline{
+			Name:    name,
+			User:    user,
+			Account: account,
+			Balance: acct.Balance,
+			Budget:  acct.Budget,
+			Seq:     s.seq,
+			Created: s.now().Format(time.RFC3339),
+		}
+		i := s.findBaseline(user, account, name)
+		var replaced *Baseline
+		if i >= 0 {
+			replaced, s.baselines[i] = s.baselines[i], b
+		} else {
+			n := 0
+			for _, o := range s.baselines {
+				if o.User == user {
+					n++
+				}
+			}
+			if n >= maxBaselines {
+				writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Too many baselines")
+				return
+			}
+			s.baselines = append(s.baselines, b)
+		}
+		if err := s.saveData(); err != nil {
+			if replaced != nil {
+				s.baselines[i] = replaced
+			} else {
+				s.baselines = s.baselines[:len(s.baselines)-1]
+			}
+			logRequestError(r, "Error saving data: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(b)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+
+		s.lock(r)
+		defer s.mu.Unlock()
+
+		if s.inMaintenance(w) {
+			return
+		}
+
+		i := s.findBaseline(user, account, name)
+		if i < 0 {
+			http.Error(w, "Baseline not found", http.StatusNotFound)
+			return
+		}
+		prev := s.baselines
+		s.baselines = make([]*Baseline, 0, len(prev)-1)
+		s.baselines = append(append(s.baselines, prev[:i]...), prev[i+1:]...)
+		if err := s.saveData(); err != nil {
+			s.baselines = prev
+			logRequestError(r, "Error saving data: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DiffResponse defines the JSON response for the diff endpoint: the
+// account's current balance and budget, their change since the baseline,
+// and the transactions logged against the account since then, oldest
+// first. At most Config.MaxPage transactions are listed, fewer with
+// Truncated set if they would take more than Config.MaxPageBytes; Count is
+// the total.
+type DiffResponse struct {
+	Baseline      Baseline      `json:"baseline"`
+	Balance       int32         `json:"balance"`
+	Budget        int32         `json:"budget"`
+	BalanceChange int64         `json:"balance_change"`
+	BudgetChange  int64         `json:"budget_change"`
+	Count         int           `json:"count"`
+	Transactions  []Transaction `json:"transactions"`
+	Truncated     bool          `json:"truncated,omitempty"`
+}
+
+// handleDiff compares an account with the baseline named by ?baseline=.
+func (s *Server) handleDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, account := requestUser(r), requestAccount(r)
+	name := r.URL.Query().Get("baseline")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Missing baseline")
+		return
+	}
+
+	// Held while reading the log too, so the transactions listed are exactly
+	// those that led to the current balance
+	s.rlock(r)
+	defer s.mu.RUnlock()
+
+	i := s.findBaseline(user, account, name)
+	if i < 0 {
+		http.Error(w, "Baseline not found", http.StatusNotFound)
+		return
+	}
+	b := *s.baselines[i]
+	acct := s.peekAccount(user, account)
+	resp := DiffResponse{
+		Baseline:      b,
+		Balance:       acct.Balance,
+		Budget:        acct.Budget,
+		BalanceChange: int64(acct.Balance) - int64(b.Balance),
+		BudgetChange:  int64(acct.Budget) - int64(b.Budget),
+		Transactions:  []Transaction{},
+	}
+	err := s.eachTransaction(func(t Transaction) {
+		if t.User != user || t.Account != account || t.Seq <= b.Seq {
+			return
+		}
+		resp.Count++
+		if len(resp.Transactions) < s.cfg.MaxPage {
+			resp.Transactions = append(resp.Transactions, t)
+		}
+	})
+	if err != nil {
+		logRequestError(r, "Error reading transaction log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	resp.Transactions, resp.Truncated = s.fitPage(resp.Transactions, false)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runRecurring applies due recurring rules immediately (catching up on any
+// missed while the server was down) and then on every tick until ctx is done.
+func (s *Server) runRecurring(ctx context.Context) {
+	s.applyRecurring(s.now())
+
+	ticker := time.NewTicker(recurringCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.applyRecurring(s.now())
+		}
+	}
+}
+
+// applyRecurring debits every rule whose NextDue date is on or before now and
+// advances NextDue by a month per application. Because NextDue is persisted
+// with the balance in the same save, a restart can never apply the same
+// occurrence twice. The transactions are only logged once that save has
+// succeeded; if it fails, the balances and NextDue dates are put back and
+// the rules are tried again on the next tick.
+func (s *Server) applyRecurring(now time.Time) {
+	today := now.Format("2006-01-02")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Due rules stay due and are caught up once maintenance mode ends
+	if s.maintenance {
+		return
+	}
+
+	type debit struct {
+		rule          *RecurringRule
+		before, after Account
+	}
+	var debits []debit
+	nextDue := make(map[*RecurringRule]string) // Dates to restore if the save fails
+	accounts := make(map[*Account]Account)     // Accounts to restore if the save fails
+	created := make(map[string]bool)           // Users whose default account is new
+	for _, rule := range s.recurring {
+		// Catch-up is bounded so a long outage (or a corrupt date) can't loop forever
+		for i := 0; i < maxRecurringCatchUp && rule.NextDue <= today; i++ {
+			due, err := time.ParseInLocation("2006-01-02", rule.NextDue, now.Location())
+			if err != nil {
+				logError("Recurring rule %d has invalid next date %q: %v", rule.ID, rule.NextDue, err)
+				break
+			}
+
+			if _, ok := s.accounts[rule.User][defaultAccountName]; !ok {
+				created[rule.User] = true
+			}
+			acct, err := s.account(rule.User, defaultAccountName)
+			if err != nil {
+				logWarn("Recurring rule %d skipped: %v", rule.ID, err)
+				break
+			}
+			if _, ok := accounts[acct]; !ok {
+				accounts[acct] = *acct
+			}
+			if _, ok := nextDue[rule]; !ok {
+				nextDue[rule] = rule.NextDue
+			}
+			if balance, ok := subInt32(acct.Balance, rule.Amount); !ok || balance < -balanceCeiling {
+				logWarn("Recurring rule %d skipped: balance would overflow", rule.ID)
+			} else {
+				before := *acct
+				acct.Version++
+				acct.Balance = balance
+				debits = append(debits, debit{rule: rule, before: before, after: *acct})
+			}
+			rule.NextDue = monthlyOccurrence(due.Year(), due.Month()+1, rule.Day, due.Location()).Format("2006-01-02")
+		}
+	}
+
+	if len(debits) == 0 {
+		return
+	}
+	if err := s.saveData(); err != nil {
+		for acct, before := range accounts {
+			*acct = before
+		}
+		for rule, due := range nextDue {
+			rule.NextDue = due
+		}
+		for user := range created {
+			delete(s.accounts[user], defaultAccountName)
+		}
+		logError("Error saving data: %v", err)
+		return
+	}
+	for _, d := range debits {
+		s.logTransaction(d.rule.User, defaultAccountName, "RECURRING", d.rule.Amount, d.rule.Category)
+		s.checkThreshold(d.rule.User, defaultAccountName, d.before, &d.after)
+	}
+	logInfo("Applied %d recurring transaction(s)", len(debits))
+}
+
+// loadLocation returns the time zone called name, or the server's local
+// time if name is empty or not a known zone.
+func loadLocation(name string) *time.Location {
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		logWarn("invalid BUDGET_TIMEZONE %q, using local time: %v", name, err)
+		return time.Local
+	}
+	return loc
+}
+
+// now returns the current time in the server's time zone. Use it, not
+// time.Now, for anything turned into a date or time of day, so that logs,
+// cutoffs and budget cycles agree.
+func (s *Server) now() time.Time {
+	return time.Now().In(s.loc)
+}
+
+// monthlyOccurrence returns the given day of a month, clamped to the last day
+// of shorter months (e.g. day 31 in February), at midnight in loc. Months
+// past December roll over.
+func monthlyOccurrence(year int, month time.Month, day int, loc *time.Location) time.Time {
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+	return time.Date(year, month, min(day, lastDay), 0, 0, 0, 0, loc)
+}
+
+// firstOccurrence returns the first date on or after now that falls on the
+// given day of the month.
+func firstOccurrence(now time.Time, day int) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	next := monthlyOccurrence(now.Year(), now.Month(), day, now.Location())
+	if next.Before(today) {
+		next = monthlyOccurrence(now.Year(), now.Month()+1, day, now.Location())
+	}
+	return next
+}
+
+// handleUndo reverses the most recent SET, SPEND, CREDIT, ADJUST, REFUND, BUDGET_CHANGE or RESET made by the
+// calling user on the account and returns the resulting balance and budget as JSON.
+func (s *Server) handleUndo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+	key := undoKey{user: user, account: name}
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	if !s.checkIfMatch(w, r, user, name) {
+		return
+	}
+
+	stack := s.undo[key]
+	acct, ok := s.accounts[user][name]
+	if len(stack) == 0 || !ok {
+		http.Error(w, "Nothing to undo", http.StatusBadRequest)
+		return
+	}
+	entry := stack[len(stack)-1]
+	balance, ok1 := subInt32(acct.Balance, entry.balanceDelta)
+	budget, ok2 := subInt32(acct.Budget, entry.budgetDelta)
+	if !ok1 || !ok2 {
+		writeOverflow(w)
+		return
+	}
+	s.undo[key] = stack[:len(stack)-1]
+
+	before := *acct
+	acct.Version++
+	acct.Balance = balance
+	acct.Budget = budget
+
+	if err := s.saveData(); err != nil {
+		*acct = before
+		s.undo[key] = stack
+		logRequestError(r, "Error saving data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log the UNDO action with the change it made to the balance. Undoing
+	// a refund says which transaction it reopens, so it can be refunded again
+	memo := ""
+	if entry.refunds != 0 {
+		memo = unrefundMemo(entry.refunds)
+	}
+	s.logTransactionMemo(user, name, "UNDO", -entry.balanceDelta, "", memo)
+	s.checkThreshold(user, name, before, acct)
+
+	s.writeAccountJSON(w, r, acct)
+}
+
+// decodeBody decodes the JSON request body into v. Bodies larger than
+// Config.MaxBodyBytes are rejected with 413, and malformed JSON or unknown
+// fields (usually a typo in a field name) with 400.
+// It writes the error response itself and returns false on failure.
+func (s *Server) decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "Request body too large")
+			return false
+		}
+		var badMoney *moneyError
+		if errors.As(err, &badMoney) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidAmount, badMoney.Error())
+			return false
+		}
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, "Invalid body")
+		return false
+	}
+	return true
+}
+
+// writeError responds with a JSON ErrorResponse and the given status code.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: code, Message: message})
+}
+
+// wantsJSON reports whether the client opted in to JSON responses from the
+// endpoints that historically returned a raw integer balance, either via an
+// "Accept: application/json" header or a "?format=json" query parameter.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeBalance responds with acct as GetResponse JSON if the client asked for
+// it (see wantsJSON), otherwise with the legacy bare integer balance that
+// older clients parse with parseInt.
+func (s *Server) writeBalance(w http.ResponseWriter, r *http.Request, acct *Account) {
+	if wantsJSON(r) {
+		s.writeAccountJSON(w, r, acct)
+		return
+	}
+	w.Header().Set("ETag", accountETag(acct))
+	w.Header().Set("X-Response-Format", "legacy")
+	fmt.Fprintf(w, "%d", acct.Balance)
+}
+
+// writeAccountJSON responds with acct, the account addressed by r, as
+// GetResponse JSON.
+func (s *Server) writeAccountJSON(w http.ResponseWriter, r *http.Request, acct *Account) {
+	w.Header().Set("ETag", accountETag(acct))
+	w.Header().Set("X-Response-Format", "json")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.accountResponse(requestUser(r), requestAccount(r), acct))
+}
+
+// accountResponse returns the GetResponse describing acct, the user's named
+// account. If the transaction log can't be read, Spent is reported as 0.
+// Caller must hold s.mu.
+func (s *Server) accountResponse(user, name string, acct *Account) GetResponse {
+	spent, err := s.periodSpent(user, name, s.now())
+	if err != nil {
+		logError("Error reading transaction log: %v", err)
+	}
+	return GetResponse{
+		Balance:   acct.Balance,
+		Budget:    acct.Budget,
+		Currency:  s.currencyOf(acct),
+		Version:   acct.Version,
+		Spent:     spent,
+		Remaining: acct.Balance,
+		Seq:       s.seq,
+		SpendSign: s.cfg.SpendSign,
+		Mode:      s.balanceMode(),
+	}
+}
+
+// balanceMode returns balanceModeDebt in debt mode, else balanceModeStrict.
+func (s *Server) balanceMode() string {
+	if s.cfg.DebtMode {
+		return balanceModeDebt
+	}
+	return balanceModeStrict
+}
+
+// lowestBalance returns the lowest balance an account may be given:
+// -MaxBalance in debt mode, otherwise just the overflow guard (spends are
+// further limited by belowFloor).
+func (s *Server) lowestBalance() int32 {
+	if s.cfg.DebtMode {
+		return -s.cfg.MaxBalance
+	}
+	return -balanceCeiling
+}
+
+// lowestBudget returns the lowest budget that may be set: -MaxBalance in
+// debt mode, where the budget is the debt to pay off, otherwise 0.
+func (s *Server) lowestBudget() int32 {
+	if s.cfg.DebtMode {
+		return -s.cfg.MaxBalance
+	}
+	return 0
+}
+
+// belowFloor reports whether a spend or negative adjustment leaving balance
+// breaks the MinBalance floor, which overdraft and debt mode both lift.
+func (s *Server) belowFloor(balance int32) bool {
+	return !s.cfg.AllowOverdraft && !s.cfg.DebtMode && balance < s.cfg.MinBalance
+}
+
+// periodSpent returns the total of the SPEND transactions logged against
+// the user's named account in the budget cycle containing now, less those
+// refunded.
+// Records written before named accounts existed belong to the default account.
+func (s *Server) periodSpent(user, name string, now time.Time) (int64, error) {
+	var total int64
+	err := s.periodSpends(user, name, now, func(t Transaction) {
+		total += int64(t.Amount)
+	})
+	return total, err
+}
+
+// categorySpent returns the totals of the account's spends in the current
+// budget cycle by category, like periodSpent. Uncategorized spends are
+// left out.
+func (s *Server) categorySpent(user, name string, now time.Time) (map[string]int64, error) {
+	totals := make(map[string]int64)
+	err := s.periodSpends(user, name, now, func(t Transaction) {
+		if t.Category != "" {
+			totals[t.Category] += int64(t.Amount)
+		}
+	})
+	return totals, err
+}
+
+// periodSpends calls fn with each SPEND of the user's named account since
+// the start of the budget cycle containing now, leaving out those refunded
+// (and not undone) since.
+func (s *Server) periodSpends(user, name string, now time.Time, fn func(Transaction)) error {
+	start, _ := cycleWindow(now, s.cfg.CycleDay)
+	cutoff := start.Format(transactionTimeLayout)
+
+	var spends []Transaction
+	refunds := make(map[int64]int)
+	add := func(t Transaction) {
+		if !t.ownedBy(user, name) {
+			return
+		}
+		if t.Action == "SPEND" {
+			spends = append(spends, t)
+		} else if seq, n := refundChange(t); n != 0 {
+			refunds[seq] += n
+		}
+	}
+	if !s.txIndex.since(cutoff, add) {
+		err := scanTransactionLog(s.cfg.TransLogFile, func(t Transaction, _ []string) {
+			if t.Date+" "+t.Time >= cutoff {
+				add(t)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range spends {
+		if refunds[t.Seq] <= 0 {
+			fn(t)
+		}
+	}
+	return nil
+}
+
+// accountETag returns the strong entity tag of acct's current version.
+func accountETag(acct *Account) string {
+	return strconv.Quote(strconv.FormatInt(acct.Version, 10))
+}
+
+// checkIfMatch implements optimistic concurrency for writes: if the request
+// carries an If-Match header that names neither "*" nor the current ETag of the
+// user's named account, it responds 409 Conflict and returns false.
+// Requests without If-Match are always allowed. Caller must hold s.mu.
+func (s *Server) checkIfMatch(w http.ResponseWriter, r *http.Request, user, name string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	current := s.peekAccount(user, name)
+	etag := accountETag(&current)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	w.Header().Set("ETag", etag)
+	writeError(w, http.StatusConflict, errCodeVersionConflict, "Account was modified by another request")
+	return false
+}
+
+// pushUndo remembers the change an action made to the user's named account
+// acct (relative to its state 'before') so it can later be reversed.
+// Caller must hold s.mu.
+func (s *Server) pushUndo(user, name string, before Account, acct *Account) {
+	s.pushUndoEntry(user, name, undoEntry{
+		balanceDelta: acct.Balance - before.Balance,
+		budgetDelta:  acct.Budget - before.Budget,
+	})
+}
+
+// pushUndoEntry adds entry to the undo stack of the user's named account.
+func (s *Server) pushUndoEntry(user, name string, entry undoEntry) {
+	key := undoKey{user: user, account: name}
+	stack := append(s.undo[key], entry)
+	// Drop the oldest entries so memory stays bounded
+	if len(stack) > maxUndoDepth {
+		stack = stack[len(stack)-maxUndoDepth:]
+	}
+	s.undo[key] = stack
+}
+
+// AlertPayload is the JSON body POSTed to Config.AlertWebhook when a balance
+// drops below Threshold percent of the budget.
+type AlertPayload struct {
+	User      string `json:"user"`
+	Account   string `json:"account"`
+	Balance   int32  `json:"balance"`
+	Budget    int32  `json:"budget"`
+	Threshold int    `json:"threshold"` // Percent of Budget
+	Currency  string `json:"currency"`
+}
+
+// alertClient sends the webhook notifications; the timeout keeps a slow
+// receiver from piling up goroutines.
+var alertClient = &http.Client{Timeout: alertTimeout}
+
+// checkThreshold fires the alert webhook if the change from 'before' to acct
+// took the balance from at or above the threshold to below it, so an alert is
+// sent once per crossing rather than on every later spend.
+// The POST runs in its own goroutine and never delays the caller.
+func (s *Server) checkThreshold(user, name string, before Account, acct *Account) {
+	if s.cfg.AlertWebhook == "" || acct.Budget <= 0 {
+		return
+	}
+	limit := int64(acct.Budget) * int64(s.cfg.AlertThreshold)
+	if int64(acct.Balance)*100 >= limit || int64(before.Balance)*100 < limit {
+		return
+	}
+
+	payload := AlertPayload{
+		User:      user,
+		Account:   name,
+		Balance:   acct.Balance,
+		Budget:    acct.Budget,
+		Threshold: s.cfg.AlertThreshold,
+		Currency:  s.currencyOf(acct),
+	}
+	go s.sendAlert(payload)
+}
+
+// sendAlert POSTs payload to the configured webhook. Failures are only logged.
+func (s *Server) sendAlert(payload AlertPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logError("Error encoding alert: %v", err)
+		return
+	}
+	resp, err := alertClient.Post(s.cfg.AlertWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logError("Error sending alert: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logError("Alert webhook returned %s", resp.Status)
+	}
+}
+
+// MonthSummary is one entry of the summary endpoint response.
+type MonthSummary struct {
+	Month string `json:"month"` // YYYY-MM
+	Total int64  `json:"total"` // Sum of signed SPEND amounts
+	Count int    `json:"count"`
+}
+
+// PeriodSummary is the summary endpoint response for ?period=current.
+// Start and End (YYYY-MM-DD) are the first and last days of the cycle.
+type PeriodSummary struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Total int64  `json:"total"` // Sum of signed SPEND amounts
+	Count int    `json:"count"`
+}
+
+// CategorySummary is one entry of the category summary endpoint response.
+type CategorySummary struct {
+	Category string `json:"category"` // uncategorizedName for spends without one
+	Total    int64  `json:"total"`    // Sum of signed SPEND amounts
+	Count    int    `json:"count"`
+}
+
+// uncategorizedName is the CategorySummary group of spends logged without
+// a category.
+const uncategorizedName = "uncategorized"
+
+// ErrorResponse defines the JSON body of validation errors.
+// Error is one of the errCode constants; Message is human-readable.
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Machine-readable error codes returned in ErrorResponse.Error.
+// These are part of the API and must not change once published.
+const (
+	errCodeInvalidBody         = "invalid_body"
+	errCodeAmountExceedsLimit  = "amount_exceeds_limit"
+	errCodeTransactionTooLarge = "transaction_too_large"
+	errCodeInsufficientBalance = "insufficient_balance"
+	errCodeUnknownCategory     = "unknown_category"
+	errCodeInvalidBudget       = "invalid_budget"
+	errCodeInvalidParameter    = "invalid_parameter"
+	errCodeInvalidAmount       = "invalid_amount"
+	errCodeVersionConflict     = "version_conflict"
+	errCodeBodyTooLarge        = "body_too_large"
+	errCodeInvalidAccount      = "invalid_account"
+	errCodeTooManyAccounts     = "too_many_accounts"
+	errCodeDailyLimitExceeded  = "daily_limit_exceeded"
+	errCodeIdempotencyConflict = "idempotency_conflict"
+	errCodeDuplicateCategory   = "duplicate_category"
+	errCodeUnknownRate         = "unknown_rate"
+	errCodeBalanceOverflow     = "balance_overflow"
+	errCodeMaintenance         = "maintenance"
+	errCodeConfirmRequired     = "confirmation_required"
+	errCodeCategoryOverBudget  = "category_budget_exceeded"
+	errCodeNotRefundable       = "not_refundable"
+	errCodeAlreadyRefunded     = "already_refunded"
+)
+
+// HealthResponse defines the JSON response for the healthz endpoint.
+type HealthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleHealthz reports whether the server can acquire its state mutex and
+// stat the data file. It has no side effects and is not behind auth.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.checkHealth(); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(HealthResponse{Status: "unavailable", Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthResponse{Status: "ok"})
+}
+
+// openAPISpec is the OpenAPI 3 description of the core endpoints served on
+// /openapi.json. It is maintained by hand: keep it in step with SetRequest,
+// SpendRequest, SetBudgetRequest and GetResponse.
+//
+//go:embed openapi.json
+var openAPISpec string
+
+// handleOpenAPI serves openAPISpec. It is not behind auth, since the
+// document holds nothing that isn't in the README.
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(openAPISpec)))
+	io.WriteString(w, openAPISpec)
+}
+
+// webApp is the front end in budget/, built into the binary so that the
+// server can host it without a separate web server.
+//
+//go:embed budget
+var webApp embed.FS
+
+// appIndex is the page served for "/".
+const appIndex = "budget.html"
+
+// appFiles returns the web app files to serve: Config.StaticDir if set, so
+// the front end can be changed without rebuilding, else the embedded copy.
+func appFiles(cfg Config) fs.FS {
+	if cfg.StaticDir != "" {
+		return os.DirFS(cfg.StaticDir)
+	}
+	files, err := fs.Sub(webApp, "budget")
+	if err != nil {
+		panic(err) // The directory is embedded at build time
+	}
+	return files
+}
+
+// appHandler serves the web app from files, with appIndex for "/". The
+// manifest and service worker get the content types browsers require to
+// install the app, and the service worker is revalidated on every load so
+// that a new version is picked up. Directories are not listed.
+func appHandler(files fs.FS) http.Handler {
+	fileServer := http.FileServerFS(files)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch path := r.URL.Path; {
+		case path == "/":
+			http.ServeFileFS(w, r, files, appIndex)
+			return
+		case strings.HasSuffix(path, "/"):
+			http.NotFound(w, r)
+			return
+		case path == "/manifest.json" || strings.HasSuffix(path, ".webmanifest"):
+			w.Header().Set("Content-Type", "application/manifest+json")
+		case path == "/sw.js":
+			w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// PingResponse defines the JSON response for the ping endpoint.
+type PingResponse struct {
+	Version       string `json:"version"`
+	Started       string `json:"started"` // RFC 3339
+	Uptime        string `json:"uptime"`  // e.g. "26h3m12s"
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+// handlePing reports the running build and how long it has been up, to
+// check which version is live after a deployment. Unlike /healthz it checks
+// nothing. It has no side effects and is not behind auth.
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uptime := time.Since(s.started)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PingResponse{
+		Version:       version,
+		Started:       s.started.Format(time.RFC3339),
+		Uptime:        uptime.Truncate(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+	})
+}
+
+// checkHealth tries to take the state read lock within healthzLockTimeout, so a
+// handler briefly holding it doesn't fail the probe but a stuck one does.
+// A missing data file is healthy: it is the normal state before the first write.
+func (s *Server) checkHealth() error {
+	deadline := time.Now().Add(healthzLockTimeout)
+	for !s.mu.TryRLock() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("state lock not acquired within %s", healthzLockTimeout)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.mu.RUnlock()
+
+	if _, err := os.Stat(s.cfg.DBFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// handleMetrics writes the counters and current totals in the Prometheus
+// text exposition format.
+// Balances are summed across all accounts rather than labelled per user:
+// with plaintext users files the user ID is the token itself, which must
+// never appear on a (possibly unauthenticated) scrape endpoint.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.rlock(r)
+	var balance, budget, accounts int64
+	for _, accts := range s.accounts {
+		for _, acct := range accts {
+			balance += int64(acct.Balance)
+			budget += int64(acct.Budget)
+			accounts++
+		}
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "budget_spend_total", "counter", "Successful /spend requests since start.", s.metrics.spends.Load())
+	writeMetric(w, "budget_credit_total", "counter", "Successful /credit requests since start.", s.metrics.credits.Load())
+	writeMetric(w, "budget_set_total", "counter", "Successful /set requests since start.", s.metrics.sets.Load())
+	writeMetric(w, "budget_unauthorized_total", "counter", "Requests rejected for a missing or invalid token since start.", s.metrics.unauthorized.Load())
+	writeMetric(w, "budget_balance", "gauge", "Sum of all account balances in minor units.", balance)
+	writeMetric(w, "budget_budget", "gauge", "Sum of all account budgets in minor units.", budget)
+	writeMetric(w, "budget_accounts", "gauge", "Number of accounts.", accounts)
+}
+
+// handleStats returns the lifetime activity counters (see Stats) as JSON.
+// They cover all users and persist across restarts, while /metrics counts
+// since start.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatsResponse{Stats: s.stats.snapshot(), Lock: s.lockStats()})
+}
+
+// writeMetric writes a single unlabelled sample with its HELP and TYPE lines.
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// HistoryPage defines the JSON response for a paginated history request.
+// Offset counts from the oldest transaction; Total is the number of
+// transactions in the whole log and Limit the page size actually applied.
+// Truncated is set if Items was cut short of Limit to keep the response
+// within Config.MaxPageBytes; the next page then starts after the last item.
+type HistoryPage struct {
+	Items     []Transaction `json:"items"`
+	Total     int           `json:"total"`
+	Offset    int           `json:"offset"`
+	Limit     int           `json:"limit"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+// handleHistory returns the most recent transactions of the caller's account
+// from the CSV log as JSON. Other users' records are never listed: with
+// plaintext users files their user ID is their token.
+// The number of entries defaults to historyLimit and can be overridden with
+// ?limit=, up to Config.MaxPage.
+// With ?offset= it instead returns a HistoryPage of up to limit transactions
+// starting that many from the oldest; an offset past the end yields no items.
+// With ?since_seq=N it returns up to limit transactions numbered after N,
+// oldest first, so a client can fetch what it has not seen yet.
+// Lists whose JSON would exceed Config.MaxPageBytes are cut short (see
+// fitPage): the oldest entries are dropped from the most recent ones, the
+// newest from the others. The plain lists have no envelope to say so, so
+// they get an X-Truncated: true header instead.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, ok := limitParam(r)
+	if !ok {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, s.cfg.MaxPage)
+	user, name := requestUser(r), requestAccount(r)
+	own := func(t Transaction) bool { return t.ownedBy(user, name) }
+
+	if v := r.URL.Query().Get("since_seq"); v != "" {
+		since, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			http.Error(w, "Invalid since_seq", http.StatusBadRequest)
+			return
+		}
+		items := []Transaction{}
+		err = s.eachTransaction(func(t Transaction) {
+			if t.Seq > since && own(t) && len(items) < limit {
+				items = append(items, t)
+			}
+		})
+		if err != nil {
+			logRequestError(r, "Error reading transaction log: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		items, truncated := s.fitPage(items, false)
+		writeTransactionList(w, items, truncated)
+		return
+	}
+
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		items, total, err := s.transactionPage(own, offset, limit)
+		if err != nil {
+			logRequestError(r, "Error reading transaction log: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		page := HistoryPage{Total: total, Offset: offset, Limit: limit}
+		page.Items, page.Truncated = s.fitPage(items, false)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	entries, err := s.lastTransactions(own, limit)
+	if err != nil {
+		logRequestError(r, "Error reading transaction log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	entries, truncated := s.fitPage(entries, true)
+	writeTransactionList(w, entries, truncated)
+}
+
+// writeTransactionList responds with items as a bare JSON array, flagging a
+// list cut short by fitPage with an X-Truncated header.
+func writeTransactionList(w http.ResponseWriter, items []Transaction, truncated bool) {
+	if truncated {
+		w.Header().Set("X-Truncated", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// fitPage shortens items so that their JSON encoding takes no more than
+// Config.MaxPageBytes, and reports whether it had to. It drops the newest
+// (last) items, or with keepNewest the oldest. The surrounding envelope is
+// not counted. At least one item is always kept, as a single transaction
+// can't get anywhere near the limit.
+func (s *Server) fitPage(items []Transaction, keepNewest bool) ([]Transaction, bool) {
+	size := 2 // The brackets of the array
+	for i := range items {
+		j := i
+		if keepNewest {
+			j = len(items) - 1 - i
+		}
+		b, err := json.Marshal(items[j])
+		if err != nil {
+			continue
+		}
+		size += len(b) + 1 // Comma or newline
+		if size > s.cfg.MaxPageBytes && i > 0 {
+			if keepNewest {
+				return items[j+1:], true
+			}
+			return items[:j], true
+		}
+	}
+	return items, false
+}
+
+// limitParam returns the positive ?limit= of a listing request, or
+// historyLimit if absent. ok is false if the value is invalid.
+func limitParam(r *http.Request) (limit int, ok bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return historyLimit, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// UnauthorizedEntry is one parsed record of the unauthorized access log.
+// Token is masked (see maskToken); for writes refused to a read-only user it
+// holds the user ID and Reason is "read_only".
+type UnauthorizedEntry struct {
+	Date   string `json:"date"`
+	Time   string `json:"time"`
+	Token  string `json:"token"`
+	IP     string `json:"ip"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Reasons recorded in the last column of unauthorized log records written
+// for authenticated users whose role does not allow the request, and when
+// an address is locked out.
+const (
+	unauthReasonReadOnly  = "read_only"  // A write attempted with a read-only token
+	unauthReasonNotAdmin  = "not_admin"  // An /admin route requested without the admin role
+	unauthReasonLockedOut = "locked_out" // Too many failed logins from the address (see recordAuthFailure)
+)
+
+// handleUnauthorizedLog returns the most recent failed authentication
+// attempts as JSON, oldest first. The number of entries defaults to
+// historyLimit and can be overridden with ?limit=, up to Config.MaxPage.
+func (s *Server) handleUnauthorizedLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, ok := limitParam(r)
+	if !ok {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := readUnauthorized(s.cfg.UnauthLogFile, min(limit, s.cfg.MaxPage))
+	if err != nil {
+		logRequestError(r, "Error reading unauthorized log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// readUnauthorized parses the "date,time,token,ip" unauthorized log and
+// returns at most the last 'limit' entries, oldest first, with the tokens
+// masked. A missing log yields an empty slice; malformed records are skipped.
+func readUnauthorized(filename string, limit int) ([]UnauthorizedEntry, error) {
+	entries := []UnauthorizedEntry{}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	cr := csv.NewReader(bufio.NewReader(file))
+	cr.FieldsPerRecord = -1 // Refused writes carry a fifth, reason, column
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				continue
+			}
+			return nil, err
+		}
+		if len(record) != 4 && len(record) != 5 {
+			continue
+		}
+		entry := UnauthorizedEntry{
+			Date:  record[0],
+			Time:  record[1],
+			Token: maskToken(record[2]),
+			IP:    record[3],
+		}
+		if len(record) == 5 {
+			entry.Reason = record[4]
+		}
+		entries = append(entries, entry)
+		// Keep only the tail so memory stays bounded by 'limit'
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+}
+
+// maskToken hides a rejected token, which is often a mistyped real one,
+// keeping only its first two characters and its length so attempts can
+// still be told apart. Invalid UTF-8 is replaced so the JSON stays valid.
+func maskToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	runes := []rune(strings.ToValidUTF8(token, "\uFFFD"))
+	if len(runes) <= 4 {
+		return fmt.Sprintf("*** (%d chars)", len(runes))
+	}
+	return fmt.Sprintf("%s*** (%d chars)", string(runes[:2]), len(runes))
+}
+
+// transactionIndex holds the most recent transactions in memory, oldest first,
+// so the reporting endpoints need not re-parse the CSV log on every request.
+// It is filled from the log at startup and then appended to by
+// writeTransaction. At most 'limit' entries are kept; once older ones have
+// been dropped, complete is false and callers needing more fall back to the file.
+type transactionIndex struct {
+	mu       sync.RWMutex
+	entries  []Transaction
+	limit    int
+	complete bool
+}
+
+// newTransactionIndex returns an empty index keeping up to limit entries.
+func newTransactionIndex(limit int) *transactionIndex {
+	return &transactionIndex{limit: limit, complete: true}
+}
+
+// load replaces the contents of the index with the tail of the log file.
+// On failure the index is left incomplete, so readers use the file instead.
+func (ix *transactionIndex) load(filename string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.entries = nil
+	ix.complete = true
+	err := scanTransactionLog(filename, func(t Transaction, _ []string) {
+		ix.appendLocked(t)
+	})
+	if err != nil {
+		ix.entries = nil
+		ix.complete = false
+	}
+	return err
+}
+
+// dropBefore removes the entries dated before cutoff (YYYY-MM-DD), after
+// they have been pruned from the log.
+func (ix *transactionIndex) dropBefore(cutoff string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	kept := ix.entries[:0]
+	for _, t := range ix.entries {
+		if t.Date >= cutoff {
+			kept = append(kept, t)
+		}
+	}
+	clear(ix.entries[len(kept):])
+	ix.entries = kept
+}
+
+// add appends a newly logged transaction.
+func (ix *transactionIndex) add(t Transaction) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.appendLocked(t)
+}
+
+// appendLocked appends t, dropping the oldest entries beyond the limit.
+// Trimming happens in batches so that the copy is amortized. Caller must hold ix.mu.
+func (ix *transactionIndex) appendLocked(t Transaction) {
+	ix.entries = append(ix.entries, t)
+	if len(ix.entries) > ix.limit+ix.limit/4 {
+		ix.entries = append([]Transaction(nil), ix.entries[len(ix.entries)-ix.limit:]...)
+		ix.complete = false
+	}
+}
+
+// tail returns a copy of the last n entries if the index holds at least that
+// many (or the whole log), and false otherwise.
+func (ix *transactionIndex) tail(n int) ([]Transaction, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if len(ix.entries) < n && !ix.complete {
+		return nil, false
+	}
+	start := max(0, len(ix.entries)-n)
+	return append([]Transaction{}, ix.entries[start:]...), true
+}
+
+// each calls fn with every entry, oldest first, under the read lock.
+// It returns false without calling fn if the index does not hold the whole log.
+func (ix *transactionIndex) each(fn func(t Transaction)) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if !ix.complete {
+		return false
+	}
+	for _, t := range ix.entries {
+		fn(t)
+	}
+	return true
+}
+
+// since calls fn with every entry logged at or after cutoff, a
+// transactionTimeLayout string, oldest first. It returns false without
+// calling fn if entries within the window may have been dropped.
+func (ix *transactionIndex) since(cutoff string, fn func(t Transaction)) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if !ix.complete && (len(ix.entries) == 0 || ix.entries[0].Date+" "+ix.entries[0].Time >= cutoff) {
+		return false
+	}
+	// Imported records may be out of order, so check every entry
+	for _, t := range ix.entries {
+		if t.Date+" "+t.Time >= cutoff {
+			fn(t)
+		}
+	}
+	return true
+}
+
+// spentSince returns the total of the user's SPEND transactions, across all
+// accounts, logged at or after cutoff (a transactionTimeLayout string).
+// Negative spends from clients predating /credit are not counted, and
+// neither are spends refunded (and not undone) since.
+func (s *Server) spentSince(user, cutoff string) (int64, error) {
+	spends := make(map[int64]int64) // By seq; unnumbered spends share 0, which can't be refunded
+	refunds := make(map[int64]int)
+	add := func(t Transaction) {
+		if t.User != user {
+			return
+		}
+		if t.Action == "SPEND" && t.Amount > 0 {
+			spends[t.Seq] += int64(t.Amount)
+		} else if seq, n := refundChange(t); n != 0 {
+			refunds[seq] += n
+		}
+	}
+	if !s.txIndex.since(cutoff, add) {
+		err := scanTransactionLog(s.cfg.TransLogFile, func(t Transaction, _ []string) {
+			if t.Date+" "+t.Time >= cutoff {
+				add(t)
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	var total int64
+	for seq, amount := range spends {
+		if refunds[seq] <= 0 {
+			total += amount
+		}
+	}
+	return total, nil
+}
+
+// eachTransaction calls fn with every logged transaction, oldest first,
+// from memory when possible and otherwise by reading the log file.
+func (s *Server) eachTransaction(fn func(t Transaction)) error {
+	if s.txIndex.each(fn) {
+		return nil
+	}
+	return scanTransactionLog(s.cfg.TransLogFile, func(t Transaction, _ []string) { fn(t) })
+}
+
+// recentTransactions returns at most the last 'limit' logged transactions,
+// oldest first, from memory when possible.
+// A missing log yields an empty slice; malformed records are skipped.
+func (s *Server) recentTransactions(limit int) ([]Transaction, error) {
+	if entries, ok := s.txIndex.tail(limit); ok {
+		return entries, nil
+	}
+
+	entries := []Transaction{}
+	err := scanTransactionLog(s.cfg.TransLogFile, func(t Transaction, _ []string) {
+		entries = append(entries, t)
+		// Keep only the tail so memory stays bounded by 'limit'
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// lastTransactions returns at most the last 'limit' logged transactions that
+// keep accepts, oldest first. Memory stays bounded by limit.
+func (s *Server) lastTransactions(keep func(Transaction) bool, limit int) ([]Transaction, error) {
+	entries := []Transaction{}
+	err := s.eachTransaction(func(t Transaction) {
+		if !keep(t) {
+			return
+		}
+		entries = append(entries, t)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// transactionPage returns up to limit of the logged transactions that keep
+// accepts, starting offset matches from the oldest, along with the number of
+// matches. Memory stays bounded by limit.
+func (s *Server) transactionPage(keep func(Transaction) bool, offset, limit int) ([]Transaction, int, error) {
+	items := []Transaction{}
+	total := 0
+	err := s.eachTransaction(func(t Transaction) {
+		if !keep(t) {
+			return
+		}
+		if total >= offset && len(items) < limit {
+			items = append(items, t)
+		}
+		total++
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return items, total, nil
+}
+
+// scanTransactionLog reads the CSV transaction log and calls fn with every
+// well-formed record, both parsed and as written. Malformed records are
+// skipped and a missing log is treated as empty.
+func scanTransactionLog(filename string, fn func(t Transaction, record []string)) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	cr := csv.NewReader(bufio.NewReader(file))
+	cr.FieldsPerRecord = -1 // Older records have fewer columns
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				continue
+			}
+			return err
+		}
+		if t, ok := parseTransaction(record); ok {
+			fn(t, record)
+		}
+	}
+}
+
+// parseTransaction parses one "date,time,user,action,amount[,category[,account[,seq[,memo[,sign]]]]]"
+// log record. Records written before categories, named accounts or sequence
+// numbers existed lack the trailing columns, as do records without a memo.
+// The amount of a SPEND logged under spendSignInflow is negated back, see
+// loggedAmount.
+func parseTransaction(fields []string) (Transaction, bool) {
+	if len(fields) < 5 || len(fields) > 10 {
+		return Transaction{}, false
+	}
+	amount, err := strconv.ParseInt(fields[4], 10, 32)
+	if err != nil {
+		return Transaction{}, false
+	}
+	t := Transaction{
+		Date:   fields[0],
+		Time:   fields[1],
+		User:   fields[2],
+		Action: fields[3],
+		Amount: int32(amount),
+	}
+	if len(fields) >= 6 {
+		t.Category = fields[5]
+	}
+	if len(fields) >= 7 {
+		t.Account = fields[6]
+	}
+	if len(fields) >= 8 {
+		seq, err := strconv.ParseInt(fields[7], 10, 64)
+		if err != nil {
+			return Transaction{}, false
+		}
+		t.Seq = seq
+	}
+	if len(fields) >= 9 {
+		t.Memo = fields[8]
+	}
+	if len(fields) == 10 {
+		var ok bool
+		if t.Amount, ok = unsignAmount(t.Action, t.Amount, fields[9]); !ok {
+			return Transaction{}, false
+		}
+	}
+	return t, isDate(t.Date)
+}
+
+// loggedAmount returns the amount column and sign column written for t.
+// Transaction amounts follow the outflow convention, a SPEND being taken
+// from the balance; under spendSignInflow a SPEND is logged negated, as the
+// client sent it, and its sign column says so. Other rows have no sign.
+func (s *Server) loggedAmount(t Transaction) (amount int32, sign string) {
+	if t.Action == "SPEND" && s.cfg.SpendSign == spendSignInflow {
+		return -t.Amount, spendSignInflow
+	}
+	return t.Amount, ""
+}
+
+// unsignAmount reverses loggedAmount for a row of the given action whose
+// sign column is sign. ok is false for an unknown sign or an amount that
+// can't be negated.
+func unsignAmount(action string, amount int32, sign string) (int32, bool) {
+	switch sign {
+	case "", spendSignOutflow:
+		return amount, true
+	case spendSignInflow:
+		if action != "SPEND" {
+			return amount, true
+		}
+		if amount == math.MinInt32 {
+			return 0, false
+		}
+		return -amount, true
+	}
+	return 0, false
+}
+
+// handleSummary aggregates SPEND transactions by month, oldest first.
+// An optional ?year=YYYY restricts the result to that year.
+// With ?period=current it instead returns a single PeriodSummary of the
+// current budget cycle (see cycleWindow).
+func (s *Server) handleSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Query().Get("period") {
+	case "":
+	case "current":
+		if r.URL.Query().Get("year") != "" {
+			http.Error(w, "'year' cannot be combined with 'period'", http.StatusBadRequest)
+			return
+		}
+		s.writePeriodSummary(w, s.now())
+		return
+	default:
+		http.Error(w, "Invalid period", http.StatusBadRequest)
+		return
+	}
+
+	year := r.URL.Query().Get("year")
+	if year != "" {
+		if _, err := time.Parse("2006", year); err != nil {
+			http.Error(w, "Invalid year", http.StatusBadRequest)
+			return
+		}
+	}
+
+	summary, err := s.summarizeByMonth(year)
+	if err != nil {
+		logRequestError(r, "Error reading transaction log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	json.NewEncoder(w).Encode(summary)
 }
 
-// logTransaction writes a valid transaction to the CSV log.
-func (s *Server) logTransaction(user, action string, amount int32) {
-	now := time.Now()
-	dateStr := now.Format("2006-01-02")
-	timeStr := now.Format("15:04:05")
-	s.transLogger.Log("%s,%s,%s,%s,%d\n", dateStr, timeStr, user, action, amount)
+// writePeriodSummary responds with the SPEND totals of the budget cycle
+// containing now.
+func (s *Server) writePeriodSummary(w http.ResponseWriter, now time.Time) {
+	start, next := cycleWindow(now, s.cfg.CycleDay)
+	summary := PeriodSummary{
+		Start: start.Format("2006-01-02"),
+		End:   next.AddDate(0, 0, -1).Format("2006-01-02"),
+	}
+
+	err := s.eachTransaction(func(t Transaction) {
+		// Dates are ISO formatted, so they compare correctly as strings
+		if t.Action == "SPEND" && t.Date >= summary.Start && t.Date <= summary.End {
+			summary.Total += int64(t.Amount)
+			summary.Count++
+		}
+	})
+	if err != nil {
+		logError("Error reading transaction log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// handleByCategory totals SPEND transactions by category, largest total
+// first, over the current budget cycle (see cycleWindow) or, given
+// ?from=YYYY-MM-DD and/or ?to=YYYY-MM-DD (both inclusive), over that range.
+// Like /summary it covers every user's spends.
+func (s *Server) handleByCategory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from, err := parseDateParam(r, "from")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	to, err := parseDateParam(r, "to")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	switch {
+	case from == "" && to == "":
+		start, next := cycleWindow(s.now(), s.cfg.CycleDay)
+		from, to = start.Format("2006-01-02"), next.AddDate(0, 0, -1).Format("2006-01-02")
+	case from != "" && to != "" && from > to:
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid range: 'from' is after 'to'")
+		return
+	}
+
+	byCategory := make(map[string]*CategorySummary)
+	err = s.eachTransaction(func(t Transaction) {
+		// Dates are ISO formatted, so they compare correctly as strings
+		if t.Action != "SPEND" || (from != "" && t.Date < from) || (to != "" && t.Date > to) {
+			return
+		}
+		category := t.Category
+		if category == "" {
+			category = uncategorizedName
+		}
+		c, ok := byCategory[category]
+		if !ok {
+			c = &CategorySummary{Category: category}
+			byCategory[category] = c
+		}
+		c.Total += int64(t.Amount)
+		c.Count++
+	})
+	if err != nil {
+		logRequestError(r, "Error reading transaction log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	summary := make([]CategorySummary, 0, len(byCategory))
+	for _, c := range byCategory {
+		summary = append(summary, *c)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Total != summary[j].Total {
+			return summary[i].Total > summary[j].Total
+		}
+		return summary[i].Category < summary[j].Category
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// cycleWindow returns the start of the budget cycle containing now and the
+// start of the next one. Cycles begin on the given day of the month, clamped
+// to the last day of shorter months (see monthlyOccurrence).
+func cycleWindow(now time.Time, day int) (start, next time.Time) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	start = monthlyOccurrence(now.Year(), now.Month(), day, now.Location())
+	if start.After(today) {
+		start = monthlyOccurrence(now.Year(), now.Month()-1, day, now.Location())
+	}
+	next = monthlyOccurrence(start.Year(), start.Month()+1, day, now.Location())
+	return start, next
+}
+
+// summarizeByMonth totals the logged SPEND entries per YYYY-MM, optionally
+// only for the given year. A missing log yields an empty slice.
+func (s *Server) summarizeByMonth(year string) ([]MonthSummary, error) {
+	byMonth := make(map[string]*MonthSummary)
+	err := s.eachTransaction(func(t Transaction) {
+		if t.Action != "SPEND" || (year != "" && !strings.HasPrefix(t.Date, year+"-")) {
+			return
+		}
+		month := t.Date[:7]
+		m, ok := byMonth[month]
+		if !ok {
+			m = &MonthSummary{Month: month}
+			byMonth[month] = m
+		}
+		m.Total += int64(t.Amount)
+		m.Count++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := []MonthSummary{}
+	for _, m := range byMonth {
+		summary = append(summary, *m)
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Month < summary[j].Month })
+	return summary, nil
+}
+
+// handleSearch returns the logged transactions of the caller's account that
+// match every given filter as a HistoryPage, oldest first:
+//   - action=A: the action, e.g. SPEND (case-insensitive);
+//   - category=C: the category;
+//   - min=N, max=N: the amount range in minor units, inclusive;
+//   - from=YYYY-MM-DD, to=YYYY-MM-DD: the date range, inclusive.
+//
+// ?offset= and ?limit= page through the matches as for /history.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	action := strings.ToUpper(q.Get("action"))
+	category := strings.ToLower(q.Get("category"))
+
+	amountParam := func(name string, def int64) (int64, bool) {
+		v := q.Get(name)
+		if v == "" {
+			return def, true
+		}
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("Invalid %s amount", name))
+			return 0, false
+		}
+		return n, true
+	}
+	minAmount, ok := amountParam("min", math.MinInt32)
+	if !ok {
+		return
+	}
+	maxAmount, ok := amountParam("max", math.MaxInt32)
+	if !ok {
+		return
+	}
+
+	from, err := parseDateParam(r, "from")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	to, err := parseDateParam(r, "to")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	limit, ok := limitParam(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid limit")
+		return
+	}
+	limit = min(limit, s.cfg.MaxPage)
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid offset")
+			return
+		}
+	}
+
+	user, name := requestUser(r), requestAccount(r)
+	page := HistoryPage{Items: []Transaction{}, Offset: offset, Limit: limit}
+	err = s.eachTransaction(func(t Transaction) {
+		switch {
+		case !t.ownedBy(user, name),
+			action != "" && t.Action != action,
+			category != "" && t.Category != category,
+			int64(t.Amount) < minAmount || int64(t.Amount) > maxAmount,
+			// Dates are ISO formatted, so they compare correctly as strings
+			from != "" && t.Date < from,
+			to != "" && t.Date > to:
+			return
+		}
+		if page.Total >= offset && len(page.Items) < limit {
+			page.Items = append(page.Items, t)
+		}
+		page.Total++
+	})
+	if err != nil {
+		logRequestError(r, "Error reading transaction log: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	page.Items, page.Truncated = s.fitPage(page.Items, false)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// handleExport streams the caller's account's rows of the transaction log as
+// a CSV download.
+// Optional ?from=YYYY-MM-DD and ?to=YYYY-MM-DD params (both inclusive)
+// restrict the rows by their date column.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from, err := parseDateParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseDateParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from != "" && to != "" && from > to {
+		http.Error(w, "Invalid range: 'from' is after 'to'", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=transactions.csv")
+	cw := csv.NewWriter(w)
+	defer cw.Flush()
+	cw.Write(strings.Split(transactionHeader, ","))
+
+	// A missing log is exported as just the header row. Once streaming has
+	// started the status can't change, so read errors are only logged.
+	user, name := requestUser(r), requestAccount(r)
+	err = scanTransactionLog(s.cfg.TransLogFile, func(t Transaction, record []string) {
+		// Dates are ISO formatted, so they compare correctly as strings
+		if !t.ownedBy(user, name) || (from != "" && t.Date < from) || (to != "" && t.Date > to) {
+			return
+		}
+		cw.Write(record)
+	})
+	if err != nil {
+		logRequestError(r, "Error reading transaction log: %v", err)
+	}
+}
+
+// ImportResult is the JSON response of the import endpoint.
+type ImportResult struct {
+	Applied int           `json:"applied"`
+	Skipped int           `json:"skipped"`
+	Errors  []ImportError `json:"errors"` // One entry per skipped row
+}
+
+// ImportError explains why a row of an import was skipped.
+type ImportError struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// handleImport applies a CSV body in the transaction log format to the
+// caller's accounts, e.g. to seed them from a spreadsheet.
+// Invalid rows are skipped and reported; a row with an unparseable amount
+// rejects the whole import. Accepted rows are appended to the transaction log
+// with their original date and time, and the result is saved once at the end.
+// SET, SPEND, RECURRING, CREDIT, ADJUST, BUDGET_CHANGE, INIT, RESET,
+// ROLLOVER and RESTORE rows are supported.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := requestUser(r)
+	result := ImportResult{Errors: []ImportError{}}
+	skip := func(line int, reason string) {
+		result.Skipped++
+		result.Errors = append(result.Errors, ImportError{Line: line, Reason: reason})
+	}
+
+	var rows []Transaction
+	var rowLines []int
+	cr := csv.NewReader(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	for first := true; ; first = false {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				skip(parseErr.StartLine, "malformed CSV")
+				continue
+			}
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, errCodeBodyTooLarge, "Import too large")
+				return
+			}
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, "Invalid body")
+			return
+		}
+		if first && record[0] == "date" {
+			continue // Header row
+		}
+
+		lineNo, _ := cr.FieldPos(0)
+		t, reason, err := s.parseImportRow(record, user)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("Line %d: %v", lineNo, err))
+			return
+		}
+		if reason != "" {
+			skip(lineNo, reason)
+			continue
+		}
+		rows = append(rows, t)
+		rowLines = append(rowLines, lineNo)
+	}
+
+	s.lock(r)
+	defer s.mu.Unlock()
+
+	if s.inMaintenance(w) {
+		return
+	}
+
+	// Apply the rows to working copies so a failed save leaves no trace
+	staged := make(map[string]*Account)
+	created := 0
+	var applied []Transaction
+	for i, t := range rows {
+		acct, ok := staged[t.Account]
+		if !ok {
+			if _, exists := s.accounts[user][t.Account]; !exists {
+				if len(s.accounts[user])+created >= s.cfg.MaxAccounts {
+					skip(rowLines[i], "too many accounts")
+					continue
+				}
+				created++
+			}
+			current := s.peekAccount(user, t.Account)
+			acct = &current
+			staged[t.Account] = acct
+		}
+		if err := s.applyImported(acct, t); err != nil {
+			skip(rowLines[i], err.Error())
+			continue
+		}
+		applied = append(applied, t)
+	}
+	result.Applied = len(applied)
+
+	if len(applied) > 0 {
+		previous := make(map[string]*Account)
+		if s.accounts[user] == nil {
+			s.accounts[user] = make(map[string]*Account)
+		}
+		for name, acct := range staged {
+			previous[name] = s.accounts[user][name]
+			s.accounts[user][name] = acct
+		}
+		// Imported rows are logged as new transactions, numbered after any
+		// sequence column the file had
+		seq := s.seq
+		for i := range applied {
+			s.seq++
+			applied[i].Seq = s.seq
+		}
+		if err := s.saveData(); err != nil {
+			s.seq = seq
+			for name, acct := range previous {
+				if acct == nil {
+					delete(s.accounts[user], name)
+				} else {
+					s.accounts[user][name] = acct
+				}
+			}
+			logRequestError(r, "Error saving data: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		for _, t := range applied {
+			s.writeTransaction(t)
+		}
+		for name, acct := range staged {
+			if before := previous[name]; before != nil {
+				s.checkThreshold(user, name, *before, acct)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// parseImportRow parses one CSV record of an import for user.
+// A non-empty reason means the row is invalid and should be skipped; err is
+// only returned for an unparseable amount, which rejects the whole import.
+func (s *Server) parseImportRow(fields []string, user string) (t Transaction, reason string, err error) {
+	if len(fields) < 5 || len(fields) > 10 {
+		return Transaction{}, "wrong number of columns", nil
+	}
+	amount, err := strconv.ParseInt(strings.TrimSpace(fields[4]), 10, 32)
+	if err != nil {
+		return Transaction{}, "", fmt.Errorf("invalid amount %q", fields[4])
+	}
+
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	t = Transaction{
+		Date:    fields[0],
+		Time:    fields[1],
+		User:    user,
+		Action:  strings.ToUpper(fields[3]),
+		Amount:  int32(amount),
+		Account: defaultAccountName,
+	}
+	if len(fields) >= 6 {
+		t.Category = strings.ToLower(fields[5])
+	}
+	if len(fields) >= 7 && fields[6] != "" {
+		t.Account = fields[6]
+	}
+	if len(fields) >= 9 {
+		t.Memo = cleanMemo(fields[8])
+	}
+	if len(fields) == 10 {
+		var ok bool
+		if t.Amount, ok = unsignAmount(t.Action, t.Amount, strings.ToLower(fields[9])); !ok {
+			return Transaction{}, "invalid sign", nil
+		}
+	}
+
+	switch {
+	case fields[2] != "" && fields[2] != user:
+		return Transaction{}, "row belongs to another user", nil
+	case !isDate(t.Date):
+		return Transaction{}, "invalid date", nil
+	case !isTime(t.Time):
+		return Transaction{}, "invalid time", nil
+	case t.Category != "" && !s.knownCategory(t.Category):
+		return Transaction{}, "unknown category", nil
+	case !validAccountName(t.Account):
+		return Transaction{}, "invalid account name", nil
+	case len(t.Memo) > maxMemoLen:
+		return Transaction{}, "memo too long", nil
+	}
+	return t, "", nil
+}
+
+// applyImported applies the effect of one imported transaction to acct,
+// leaving it untouched if the transaction is invalid. Balances are held to
+// the same limits as the live handlers. REFUND rows are refused: their memo
+// would mark a spend in the caller's log as refunded.
+func (s *Server) applyImported(acct *Account, t Transaction) error {
+	next := *acct
+	outOfRange := func(bal int32) bool {
+		return bal > s.cfg.MaxBalance || bal < s.lowestBalance()
+	}
+	switch t.Action {
+	case "SET", "RESTORE":
+		if outOfRange(t.Amount) {
+			return errors.New("amount exceeds limit")
+		}
+		next.Balance = t.Amount
+	case "SPEND", "RECURRING":
+		if t.Amount > s.cfg.MaxTransaction || t.Amount < -s.cfg.MaxTransaction {
+			return errors.New("transaction too large")
+		}
+		bal, ok := subInt32(next.Balance, t.Amount)
+		switch {
+		case !ok:
+			return errors.New("balance would overflow")
+		case s.belowFloor(bal):
+			return errors.New("insufficient balance")
+		case outOfRange(bal):
+			return errors.New("balance would exceed limit")
+		}
+		next.Balance = bal
+	case "CREDIT":
+		if t.Amount <= 0 || t.Amount > s.cfg.MaxTransaction {
+			return errors.New("invalid credit amount")
+		}
+		bal, ok := addInt32(next.Balance, t.Amount)
+		switch {
+		case !ok:
+			return errors.New("balance would overflow")
+		case bal > s.cfg.MaxBalance:
+			return errors.New("balance would exceed limit")
+		}
+		next.Balance = bal
+	case "ADJUST":
+		if t.Amount > s.cfg.MaxTransaction || t.Amount < -s.cfg.MaxTransaction {
+			return errors.New("transaction too large")
+		}
+		bal, ok := addInt32(next.Balance, t.Amount)
+		switch {
+		case !ok:
+			return errors.New("balance would overflow")
+		case t.Amount < 0 && s.belowFloor(bal):
+			return errors.New("insufficient balance")
+		case outOfRange(bal):
+			return errors.New("balance would exceed limit")
+		}
+		next.Balance = bal
+	case "BUDGET_CHANGE":
+		if t.Amount < s.lowestBudget() || t.Amount > s.cfg.MaxBalance {
+			return errors.New("invalid budget amount")
+		}
+		diff, ok := subInt32(t.Amount, next.Budget)
+		bal, ok2 := addInt32(next.Balance, diff)
+		switch {
+		case !ok || !ok2:
+			return errors.New("balance would overflow")
+		case outOfRange(bal):
+			return errors.New("balance would exceed limit")
+		}
+		next.Balance = bal
+		next.Budget = t.Amount
+	case "INIT":
+		budget, err := parseInitMemo(t.Memo)
+		if err != nil {
+			return err
+		}
+		if budget < s.lowestBudget() || budget > s.cfg.MaxBalance {
+			return errors.New("invalid budget amount")
+		}
+		if outOfRange(t.Amount) {
+			return errors.New("amount exceeds limit")
+		}
+		next.Balance = t.Amount
+		next.Budget = budget
+	case "RESET":
+		next.Balance = next.Budget
+	case "ROLLOVER":
+		// Starts a new period; the BUDGET_CHANGE logged after it then moves
+		// the balance to the new budget, which includes the carried amount
+		next.Balance = next.Budget
+	default:
+		return fmt.Errorf("unsupported action %q", t.Action)
+	}
+	next.Version++
+	*acct = next
+	return nil
+}
+
+// isDate reports whether v is a YYYY-MM-DD date.
+func isDate(v string) bool {
+	_, err := time.Parse("2006-01-02", v)
+	return err == nil
+}
+
+// isTime reports whether v is an HH:MM:SS time of day.
+func isTime(v string) bool {
+	_, err := time.Parse("15:04:05", v)
+	return err == nil
+}
+
+// parseDateParam returns the named query parameter after checking it is a
+// YYYY-MM-DD date. An absent parameter yields "".
+func parseDateParam(r *http.Request, name string) (string, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return "", nil
+	}
+	if _, err := time.Parse("2006-01-02", v); err != nil {
+		return "", fmt.Errorf("invalid '%s' date %q: expected YYYY-MM-DD", name, v)
+	}
+	return v, nil
+}
+
+// logTransaction writes a valid transaction to the CSV log, timestamped now.
+func (s *Server) logTransaction(user, account, action string, amount int32, category string) {
+	s.logTransactionMemo(user, account, action, amount, category, "")
+}
+
+// logTransactionMemo is logTransaction for a transaction with a memo.
+func (s *Server) logTransactionMemo(user, account, action string, amount int32, category, memo string) {
+	now := s.now()
+	s.seq++
+	s.dirty = true
+	s.writeTransaction(Transaction{
+		Date:     now.Format("2006-01-02"),
+		Time:     now.Format("15:04:05"),
+		User:     user,
+		Action:   action,
+		Amount:   amount,
+		Category: category,
+		Account:  account,
+		Seq:      s.seq,
+		Memo:     memo,
+	})
+}
+
+// writeTransaction appends t to the CSV log, with its amount signed as
+// loggedAmount says.
+// The category (empty when not applicable), account name and sequence number
+// are appended as trailing columns so readers of the original five columns
+// keep working. The memo follows only when there is one or a sign column
+// comes after it, so other records keep their eight columns.
+// Every change to a balance is logged here, so this is also where /events
+// clients are told about it.
+func (s *Server) writeTransaction(t Transaction) {
+	amount, sign := s.loggedAmount(t)
+	fields := []string{t.Date, t.Time, t.User, t.Action, strconv.FormatInt(int64(amount), 10),
+		t.Category, t.Account, strconv.FormatInt(t.Seq, 10)}
+	if t.Memo != "" || sign != "" {
+		fields = append(fields, t.Memo)
+	}
+	if sign != "" {
+		fields = append(fields, sign)
+	}
+	s.transLogger.LogRecord(fields...)
+	s.txIndex.add(t)
+	s.notifySubscribers(t.User, t.Account)
+}
+
+// cleanMemo trims a memo and replaces its control characters, line breaks
+// included, with spaces, so that each transaction stays on one line of the
+// log.
+func cleanMemo(memo string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, memo))
+}
+
+// clientIP returns the address recorded for r in the unauthorized log.
+// That is r.RemoteAddr unless the connection comes from one of
+// Config.TrustedProxies, in which case X-Forwarded-For is walked from the
+// right, skipping further trusted proxies, and the first other address is
+// returned. X-Real-IP is used if X-Forwarded-For is absent. Only the
+// entries added by trusted proxies can be relied upon: anything to their
+// left was sent by the client and may be forged.
+func (s *Server) clientIP(r *http.Request) string {
+	if len(s.cfg.TrustedProxies) == 0 {
+		return r.RemoteAddr
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !s.trustedProxy(remote) {
+		return r.RemoteAddr
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		client := remote
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				// A garbled entry cannot be attributed; keep the last good hop
+				break
+			}
+			client = addr
+			if !s.trustedProxy(addr) {
+				break
+			}
+		}
+		return client.Unmap().String()
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return r.RemoteAddr
+}
+
+// trustedProxy reports whether addr is in Config.TrustedProxies.
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range s.cfg.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 // logUnauthorized writes an invalid access attempt to the separate log.
 func (s *Server) logUnauthorized(user, ip string) {
-	now := time.Now()
+	now := s.now()
 	dateStr := now.Format("2006-01-02")
 	timeStr := now.Format("15:04:05")
-	s.unauthLogger.Log("%s,%s,%s,%s\n", dateStr, timeStr, user, ip)
+	s.unauthLogger.LogRecord(dateStr, timeStr, user, ip)
+}
+
+// logAccess records a successful read in the access log.
+func (s *Server) logAccess(user, path string, status int) {
+	now := s.now()
+	s.accessLogger.LogRecord(now.Format("2006-01-02"), now.Format("15:04:05"), user, path, strconv.Itoa(status))
+}
+
+// logForbidden records a request refused because of the user's role in the
+// unauthorized log, with a trailing reason column.
+func (s *Server) logForbidden(user, ip, reason string) {
+	now := s.now()
+	s.unauthLogger.LogRecord(now.Format("2006-01-02"), now.Format("15:04:05"), user, ip, reason)
 }
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a Server with the default configuration, keeping its
+// data file and logs in a temporary directory.
+func newTestServer(tb testing.TB) *Server {
+	tb.Helper()
+	dir := tb.TempDir()
+	tb.Setenv("BUDGET_DATA_DIR", dir)
+	tb.Setenv("BUDGET_LOG_DIR", dir)
+	cfg := loadConfig()
+
+	s := newServer(cfg, time.Now())
+	tl, err := NewRotatingLogger(cfg.TransLogFile, cfg.FileMode, cfg.LogMaxBytes, cfg.LogKeep)
+	if err != nil {
+		tb.Fatalf("opening transaction log: %v", err)
+	}
+	tb.Cleanup(func() { tl.Close() })
+	ul, err := NewRotatingLogger(cfg.UnauthLogFile, cfg.FileMode, cfg.LogMaxBytes, cfg.LogKeep)
+	if err != nil {
+		tb.Fatalf("opening unauthorized log: %v", err)
+	}
+	tb.Cleanup(func() { ul.Close() })
+	s.transLogger, s.unauthLogger = tl, ul
+	return s
+}
+
+// serve calls h with a request from user A to target and returns the
+// recorded response.
+func serve(h http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), ctxUserKey, "A"))
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestInt32Arithmetic(t *testing.T) {
+	tests := []struct {
+		a, b          int32
+		sum, diff     int32
+		sumOK, diffOK bool
+	}{
+		{math.MaxInt32, 0, math.MaxInt32, math.MaxInt32, true, true},
+		{math.MaxInt32, 1, 0, math.MaxInt32 - 1, false, true},
+		{math.MaxInt32 - 1, 1, math.MaxInt32, math.MaxInt32 - 2, true, true},
+		{math.MaxInt32, -1, math.MaxInt32 - 1, 0, true, false},
+		{math.MinInt32, 0, math.MinInt32, math.MinInt32, true, true},
+		{math.MinInt32, -1, 0, math.MinInt32 + 1, false, true},
+		{math.MinInt32 + 1, -1, math.MinInt32, math.MinInt32 + 2, true, true},
+		{math.MinInt32, 1, math.MinInt32 + 1, 0, true, false},
+		{0, math.MinInt32, math.MinInt32, 0, true, false},
+		{-1, math.MinInt32, 0, math.MaxInt32, false, true},
+		{balanceCeiling, balanceCeiling, 0, 0, false, true},
+		{-balanceCeiling, balanceCeiling, 0, 0, true, false},
+	}
+	for _, tt := range tests {
+		sum, ok := addInt32(tt.a, tt.b)
+		if ok != tt.sumOK || (ok && sum != tt.sum) {
+			t.Errorf("addInt32(%d, %d) = %d, %t; want %d, %t", tt.a, tt.b, sum, ok, tt.sum, tt.sumOK)
+		}
+		diff, ok := subInt32(tt.a, tt.b)
+		if ok != tt.diffOK || (ok && diff != tt.diff) {
+			t.Errorf("subInt32(%d, %d) = %d, %t; want %d, %t", tt.a, tt.b, diff, ok, tt.diff, tt.diffOK)
+		}
+	}
+}
+
+func TestAmountBoundaries(t *testing.T) {
+	s := newTestServer(t)
+	maxBal := int64(s.cfg.MaxBalance)
+	maxTx := int64(s.cfg.MaxTransaction)
+	const maxInt, minInt = int64(math.MaxInt32), int64(math.MinInt32)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		field   string
+		amount  int64
+		start   Account // State of the account before the request
+		code    string  // Expected error code, "" for success
+		balance int32   // Balance after a successful request
+	}{
+		{"set max balance", s.handleSet, "/set", "amount", maxBal, Account{}, "", int32(maxBal)},
+		{"set above max balance", s.handleSet, "/set", "amount", maxBal + 1, Account{}, errCodeAmountExceedsLimit, 0},
+		{"set -max balance", s.handleSet, "/set", "amount", -maxBal, Account{}, "", int32(-maxBal)},
+		{"set below -max balance", s.handleSet, "/set", "amount", -maxBal - 1, Account{}, errCodeAmountExceedsLimit, 0},
+		{"set MaxInt32", s.handleSet, "/set", "amount", maxInt, Account{}, errCodeAmountExceedsLimit, 0},
+		{"set MaxInt32+1", s.handleSet, "/set", "amount", maxInt + 1, Account{}, errCodeInvalidBody, 0},
+		{"set MaxInt32-1", s.handleSet, "/set", "amount", maxInt - 1, Account{}, errCodeAmountExceedsLimit, 0},
+		{"set MinInt32", s.handleSet, "/set", "amount", minInt, Account{}, errCodeAmountExceedsLimit, 0},
+		{"set MinInt32+1", s.handleSet, "/set", "amount", minInt + 1, Account{}, errCodeAmountExceedsLimit, 0},
+		{"set MinInt32-1", s.handleSet, "/set", "amount", minInt - 1, Account{}, errCodeInvalidBody, 0},
+
+		{"spend max transaction", s.handleSpend, "/spend", "amount", maxTx, Account{Balance: int32(maxBal)}, "", int32(maxBal - maxTx)},
+		{"spend above max transaction", s.handleSpend, "/spend", "amount", maxTx + 1, Account{Balance: int32(maxBal)}, errCodeTransactionTooLarge, 0},
+		{"spend MaxInt32", s.handleSpend, "/spend", "amount", maxInt, Account{Balance: int32(maxBal)}, errCodeTransactionTooLarge, 0},
+		{"spend MaxInt32+1", s.handleSpend, "/spend", "amount", maxInt + 1, Account{Balance: int32(maxBal)}, errCodeInvalidBody, 0},
+		{"spend MinInt32", s.handleSpend, "/spend?allow_negative=true", "amount", minInt, Account{}, errCodeTransactionTooLarge, 0},
+		{"spend MinInt32+1", s.handleSpend, "/spend?allow_negative=true", "amount", minInt + 1, Account{}, errCodeTransactionTooLarge, 0},
+		{"spend MinInt32-1", s.handleSpend, "/spend?allow_negative=true", "amount", minInt - 1, Account{}, errCodeInvalidBody, 0},
+		{"refund past max balance", s.handleSpend, "/spend?allow_negative=true", "amount", -1, Account{Balance: int32(maxBal)}, errCodeAmountExceedsLimit, 0},
+
+		{"budget max balance", s.handleSetBudget, "/set_budget", "budget", maxBal, Account{}, "", int32(maxBal)},
+		{"budget above max balance", s.handleSetBudget, "/set_budget", "budget", maxBal + 1, Account{}, errCodeInvalidBudget, 0},
+		{"budget -max balance", s.handleSetBudget, "/set_budget", "budget", -maxBal, Account{}, errCodeInvalidBudget, 0},
+		{"budget MaxInt32", s.handleSetBudget, "/set_budget", "budget", maxInt, Account{}, errCodeInvalidBudget, 0},
+		{"budget MaxInt32+1", s.handleSetBudget, "/set_budget", "budget", maxInt + 1, Account{}, errCodeInvalidBody, 0},
+		{"budget MinInt32", s.handleSetBudget, "/set_budget", "budget", minInt, Account{}, errCodeInvalidBudget, 0},
+		{"budget MinInt32-1", s.handleSetBudget, "/set_budget", "budget", minInt - 1, Account{}, errCodeInvalidBody, 0},
+		{"budget raising balance past max", s.handleSetBudget, "/set_budget", "budget", maxBal, Account{Balance: 1}, errCodeAmountExceedsLimit, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := tt.start
+			s.accounts["A"] = map[string]*Account{defaultAccountName: &start}
+			body := `{"` + tt.field + `": ` + strconv.FormatInt(tt.amount, 10) + `}`
+			target := tt.target + "?format=json"
+			if strings.Contains(tt.target, "?") {
+				target = tt.target + "&format=json"
+			}
+			w := serve(tt.handler, http.MethodPost, target, body)
+
+			if tt.code != "" {
+				var resp ErrorResponse
+				json.Unmarshal(w.Body.Bytes(), &resp)
+				if w.Code != http.StatusBadRequest || resp.Error != tt.code {
+					t.Fatalf("got %d %q, want 400 %q", w.Code, resp.Error, tt.code)
+				}
+				if got := s.accounts["A"][defaultAccountName].Balance; got != tt.start.Balance {
+					t.Errorf("balance changed to %d on a rejected request", got)
+				}
+				return
+			}
+			var resp GetResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); w.Code != http.StatusOK || err != nil {
+				t.Fatalf("got %d %s, want 200", w.Code, w.Body)
+			}
+			if resp.Balance != tt.balance {
+				t.Errorf("balance = %d, want %d", resp.Balance, tt.balance)
+			}
+		})
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in    string
+		scale int32
+		want  int32
+		err   string // Substring of the expected error, "" for success
+	}{
+		{"0.1", 2, 10, ""},
+		{"12.34", 2, 1234, ""},
+		{"100", 2, 10000, ""},
+		{"0", 2, 0, ""},
+		{"0.00", 2, 0, ""},
+		{"0000000000.01", 2, 1, ""},
+		{"12", 0, 12, ""},
+		{"1.234", 3, 1234, ""},
+
+		{"-0.5", 2, -50, ""},
+		{"-12.34", 2, -1234, ""},
+		{"-0", 2, 0, ""},
+
+		{"100.005", 2, 0, "at most 2 decimal places"},
+		{"0.001", 2, 0, "at most 2 decimal places"},
+		{"-0.125", 2, 0, "at most 2 decimal places"},
+		{"1.5", 0, 0, "at most 0 decimal places"},
+
+		{"21474836.47", 2, math.MaxInt32, ""},
+		{"-21474836.48", 2, math.MinInt32, ""},
+		{"21474836.48", 2, 0, "out of range"},
+		{"-21474836.49", 2, 0, "out of range"},
+		{"99999999999999999999", 2, 0, "out of range"},
+
+		{"", 2, 0, "expected a decimal number"},
+		{"-", 2, 0, "expected a decimal number"},
+		{".5", 2, 0, "expected a decimal number"},
+		{"5.", 2, 0, "expected a decimal number"},
+		{"+5", 2, 0, "expected a decimal number"},
+		{"--5", 2, 0, "expected a decimal number"},
+		{"1e3", 2, 0, "expected a decimal number"},
+		{"1.2.3", 2, 0, "expected a decimal number"},
+		{"1,000", 2, 0, "expected a decimal number"},
+		{" 1", 2, 0, "expected a decimal number"},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney(tt.in, tt.scale)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("parseMoney(%q, %d): unexpected error %v", tt.in, tt.scale, err)
+		case tt.err == "" && got != tt.want:
+			t.Errorf("parseMoney(%q, %d) = %d, want %d", tt.in, tt.scale, got, tt.want)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("parseMoney(%q, %d) = %d, %v; want error containing %q", tt.in, tt.scale, got, err, tt.err)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+		ok   bool
+	}{
+		{`1234`, 1234, true},
+		{`-50`, -50, true},
+		{`"12.34"`, 1234, true},
+		{`"-0.5"`, -50, true},
+		{`"0.1"`, 10, true},
+		{`2147483647`, math.MaxInt32, true},
+		{`2147483648`, 0, false},
+		{`-2147483649`, 0, false},
+		{`"100.005"`, 0, false},
+		{`"abc"`, 0, false},
+		{`12.5`, 0, false}, // Minor units must be whole
+		{`null`, 0, true},
+	}
+	for _, tt := range tests {
+		var m Money
+		err := json.Unmarshal([]byte(tt.in), &m)
+		if (err == nil) != tt.ok || m != tt.want {
+			t.Errorf("Unmarshal(%s) = %d, %v; want %d, ok %t", tt.in, m, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRoundQuo(t *testing.T) {
+	tests := []struct {
+		num, den         int64
+		halfUp, halfEven int64
+	}{
+		// Exact halves, even and odd integer parts, both signs
+		{5, 10, 1, 0},
+		{15, 10, 2, 2},
+		{25, 10, 3, 2},
+		{35, 10, 4, 4},
+		{-5, 10, -1, 0},
+		{-15, 10, -2, -2},
+		{-25, 10, -3, -2},
+		{-35, 10, -4, -4},
+		{1, 2, 1, 0},
+		{-1, 2, -1, 0},
+		{2147483647, 2, 1073741824, 1073741824},
+		{-2147483647, 2, -1073741824, -1073741824},
+		// Either side of a half, where both modes agree
+		{24, 10, 2, 2},
+		{26, 10, 3, 3},
+		{-24, 10, -2, -2},
+		{-26, 10, -3, -3},
+		{249999, 100000, 2, 2},
+		{250001, 100000, 3, 3},
+		// Exact quotients
+		{0, 7, 0, 0},
+		{20, 10, 2, 2},
+		{-20, 10, -2, -2},
+	}
+	for _, tt := range tests {
+		num, den := big.NewInt(tt.num), big.NewInt(tt.den)
+		if got := roundQuo(num, den, roundHalfUp); got.Int64() != tt.halfUp {
+			t.Errorf("roundQuo(%d, %d, half_up) = %s, want %d", tt.num, tt.den, got, tt.halfUp)
+		}
+		if got := roundQuo(num, den, roundHalfEven); got.Int64() != tt.halfEven {
+			t.Errorf("roundQuo(%d, %d, half_even) = %s, want %d", tt.num, tt.den, got, tt.halfEven)
+		}
+		if num.Int64() != tt.num || den.Int64() != tt.den {
+			t.Errorf("roundQuo(%d, %d) modified its arguments", tt.num, tt.den)
+		}
+	}
+}
+
+// BenchmarkConcurrentGet measures /get under parallel load, where readers
+// share the read lock on the state.
+func BenchmarkConcurrentGet(b *testing.B) {
+	s := newTestServer(b)
+	s.accounts["A"] = map[string]*Account{defaultAccountName: {Balance: 5000, Budget: 10000}}
+	for range 100 {
+		s.logTransaction("A", defaultAccountName, "SPEND", 1, "")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if w := serve(s.handleGet, http.MethodGet, "/get", ""); w.Code != http.StatusOK {
+				b.Fatalf("got %d, want 200", w.Code)
+			}
+		}
+	})
+}
+
+func TestSpendAmount(t *testing.T) {
+	tests := []struct {
+		sign   string
+		amount int32
+		want   int32
+		ok     bool
+	}{
+		{spendSignOutflow, 500, 500, true},
+		{spendSignOutflow, -500, -500, true},
+		{spendSignOutflow, math.MinInt32, math.MinInt32, true},
+		{spendSignInflow, -500, 500, true},
+		{spendSignInflow, 500, -500, true},
+		{spendSignInflow, math.MaxInt32, -math.MaxInt32, true},
+		{spendSignInflow, math.MinInt32 + 1, math.MaxInt32, true},
+		{spendSignInflow, math.MinInt32, 0, false},
+	}
+	for _, tt := range tests {
+		s := &Server{cfg: Config{SpendSign: tt.sign}}
+		got, ok := s.spendAmount(tt.amount)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s spendAmount(%d) = %d, %t; want %d, %t", tt.sign, tt.amount, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHashLimit(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.HashLimit = 2
+	s.cfg.LockoutFails = 0
+	for _, name := range []string{"C", "D"} {
+		salt := []byte("salt-" + name)
+		s.hashedUsers = append(s.hashedUsers, hashedUser{name: name, iter: 1, salt: salt, hash: hashToken("token-"+name, salt, 1)})
+	}
+	h := s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+	request := func(token, addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/get", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	// Each unknown token costs one check per hashed user
+	if w := request("wrong", "192.0.2.1:1000"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("first wrong token: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w := request("token-C", "192.0.2.1:1001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("token after the limit: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+
+	// Other addresses have their own budget, and verified tokens are cached
+	if w := request("token-C", "192.0.2.2:1000"); w.Code != http.StatusOK {
+		t.Fatalf("token from another address: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := request("token-C", "192.0.2.1:1002"); w.Code != http.StatusOK {
+		t.Errorf("cached token after the limit: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestTransactionsScopedToAccount(t *testing.T) {
+	s := newTestServer(t)
+	s.logTransaction("A", defaultAccountName, "SPEND", 1, "")
+	s.logTransaction("A", "savings", "SPEND", 2, "")
+	s.logTransaction("B", defaultAccountName, "SPEND", 3, "")
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		account string // Path account, "" for the unscoped route
+		want    int32  // Amount of the only row expected
+	}{
+		{"history", s.handleHistory, "/history", "", 1},
+		{"history page", s.handleHistory, "/history?offset=0", "", 1},
+		{"history since_seq", s.handleHistory, "/history?since_seq=0", "", 1},
+		{"named history", s.handleHistory, "/accounts/savings/history", "savings", 2},
+		{"search", s.handleSearch, "/transactions/search", "", 1},
+		{"named search", s.handleSearch, "/accounts/savings/transactions/search", "savings", 2},
+		{"export", s.handleExport, "/transactions/export", "", 1},
+		{"named export", s.handleExport, "/accounts/savings/transactions/export", "savings", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r = r.WithContext(context.WithValue(r.Context(), ctxUserKey, "A"))
+			if tt.account != "" {
+				r.SetPathValue("name", tt.account)
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+
+			body := w.Body.String()
+			if strings.Contains(body, `"B"`) || strings.Contains(body, ",B,") {
+				t.Errorf("response lists another user: %s", body)
+			}
+			if strings.HasSuffix(tt.target, "export") {
+				rows := strings.Split(strings.TrimSpace(body), "\n")
+				if len(rows) != 2 || !strings.Contains(rows[1], ",SPEND,"+strconv.Itoa(int(tt.want))+",") {
+					t.Errorf("got rows %q, want the header and one row of %d", rows, tt.want)
+				}
+				return
+			}
+			var items []Transaction
+			if page := (HistoryPage{}); strings.HasPrefix(body, "{") {
+				json.Unmarshal(w.Body.Bytes(), &page)
+				items = page.Items
+			} else {
+				json.Unmarshal(w.Body.Bytes(), &items)
+			}
+			if len(items) != 1 || items[0].Amount != tt.want {
+				t.Errorf("got %+v, want one transaction of %d", items, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockoutNotClearedByLogin(t *testing.T) {
+	s := newTestServer(t)
+	s.cfg.LockoutFails = 3
+	s.plainUsers = []plainUser{{name: "A", digest: sha256.Sum256([]byte("A"))}}
+	h := s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+	request := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/get", nil)
+		r.RemoteAddr = "192.0.2.1:1000"
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	// A valid token between guesses must not buy more guesses
+	for i, token := range []string{"x", "A", "y", "A", "z"} {
+		if code := request(token); code == http.StatusTooManyRequests {
+			t.Fatalf("request %d locked out early", i)
+		}
+	}
+	if code := request("A"); code != http.StatusTooManyRequests {
+		t.Errorf("after 3 failures: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	s := newTestServer(t)
+	s.accounts["A"] = map[string]*Account{defaultAccountName: {Balance: 1000, Budget: 1000}}
+	balance := func() int32 { return s.accounts["A"][defaultAccountName].Balance }
+	spent := func() int64 {
+		n, err := s.periodSpent("A", defaultAccountName, s.now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	refund := func(seq int64) (int, string) {
+		w := serve(s.handleRefund, http.MethodPost, "/refund", `{"seq": `+strconv.FormatInt(seq, 10)+`}`)
+		var resp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Error
+	}
+
+	if w := serve(s.handleSpend, http.MethodPost, "/spend", `{"amount": 300}`); w.Code != http.StatusOK {
+		t.Fatalf("spend: got %d %s", w.Code, w.Body)
+	}
+	seq := s.seq
+
+	if code, _ := refund(seq); code != http.StatusOK || balance() != 1000 || spent() != 0 {
+		t.Fatalf("refund: got %d, balance %d, spent %d; want 200, 1000, 0", code, balance(), spent())
+	}
+	if code, errCode := refund(seq); code != http.StatusConflict || errCode != errCodeAlreadyRefunded {
+		t.Errorf("second refund: got %d %q, want 409 %q", code, errCode, errCodeAlreadyRefunded)
+	}
+
+	// Undoing the refund reopens the spend
+	if w := serve(s.handleUndo, http.MethodPost, "/undo", ""); w.Code != http.StatusOK {
+		t.Fatalf("undo: got %d %s", w.Code, w.Body)
+	}
+	if balance() != 700 || spent() != 300 {
+		t.Errorf("after undo: balance %d, spent %d; want 700, 300", balance(), spent())
+	}
+	if code, errCode := refund(seq); code != http.StatusOK {
+		t.Errorf("refund after undo: got %d %q, want 200", code, errCode)
+	}
+
+	// A refund logged for another user doesn't count as a refund of A's spend
+	logged := func(user, account, action string, amount int32, memo string) int64 {
+		now := s.now()
+		s.seq++
+		s.writeTransaction(Transaction{Date: now.Format("2006-01-02"), Time: now.Format("15:04:05"),
+			User: user, Action: action, Amount: amount, Account: account, Seq: s.seq, Memo: memo})
+		return s.seq
+	}
+	other := logged("A", defaultAccountName, "SPEND", 100, "")
+	logged("B", defaultAccountName, "REFUND", 100, refundMemo(other))
+	if code, errCode := refund(other); code != http.StatusOK {
+		t.Errorf("refund after another user's: got %d %q, want 200", code, errCode)
+	}
+
+	// Records from before named accounts belong to the default account
+	legacy := logged("A", "", "SPEND", 50, "")
+	if code, errCode := refund(legacy); code != http.StatusOK {
+		t.Errorf("refund of a record without an account: got %d %q, want 200", code, errCode)
+	}
+}
+
+func TestImportBounds(t *testing.T) {
+	s := newTestServer(t)
+	s.accounts["A"] = map[string]*Account{defaultAccountName: {Balance: 1000, Budget: 1000}}
+
+	rows := []string{
+		"2026-01-01,10:00:00,A,SET,-2147483648,,,,",
+		"2026-01-01,10:00:00,A,INIT,-2147483648,,,,budget=1000",
+		"2026-01-01,10:00:00,A,SPEND,5000,,,,",
+		"2026-01-01,10:00:00,A,ADJUST,-5000,,,,",
+		"2026-01-01,10:00:00,A,REFUND,300,,,,refunds=1",
+	}
+	w := serve(s.handleImport, http.MethodPost, "/import", strings.Join(rows, "\n"))
+	var result ImportResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("import: got %d %s", w.Code, w.Body)
+	}
+	if result.Applied != 0 || result.Skipped != len(rows) {
+		t.Errorf("got %d applied, %d skipped (%v); want every row skipped", result.Applied, result.Skipped, result.Errors)
+	}
+	if bal := s.accounts["A"][defaultAccountName].Balance; bal != 1000 {
+		t.Errorf("balance: got %d, want 1000", bal)
+	}
+}
+
+func TestFailedSaveDropsNewAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(*Server, http.ResponseWriter, *http.Request)
+		body    string
+	}{
+		{"set", (*Server).handleSet, `{"amount": 100}`},
+		{"credit", (*Server).handleCredit, `{"amount": 100}`},
+		{"adjust", (*Server).handleAdjust, `{"delta": 100}`},
+		{"set_budget", (*Server).handleSetBudget, `{"budget": 100}`},
+		{"init", (*Server).handleInit, `{"balance": 100, "budget": 100}`},
+		{"currency", (*Server).handleSetCurrency, `{"currency": "EUR"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			// Saves fail: the data file's directory doesn't exist
+			s.cfg.DBFile = filepath.Join(t.TempDir(), "missing", "budget.json")
+
+			r := httptest.NewRequest(http.MethodPost, "/accounts/trip/"+tt.name, strings.NewReader(tt.body))
+			r = r.WithContext(context.WithValue(r.Context(), ctxUserKey, "A"))
+			r.SetPathValue("name", "trip")
+			w := httptest.NewRecorder()
+			tt.handler(s, w, r)
+
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("got %d %s, want 500", w.Code, w.Body)
+			}
+			if _, ok := s.accounts["A"]["trip"]; ok {
+				t.Error("account created by the failed write was kept")
+			}
+		})
+	}
+}
+
+func TestSpendSignLogged(t *testing.T) {
+	s := newTestServer(t)
+	s.accounts["A"] = map[string]*Account{defaultAccountName: {Balance: 1000, Budget: 1000}}
+
+	s.cfg.SpendSign = spendSignInflow
+	if w := serve(s.handleSpend, http.MethodPost, "/spend", `{"amount": -300}`); w.Code != http.StatusOK {
+		t.Fatalf("inflow spend: got %d %s", w.Code, w.Body)
+	}
+	s.cfg.SpendSign = spendSignOutflow
+	if w := serve(s.handleSpend, http.MethodPost, "/spend", `{"amount": 200}`); w.Code != http.StatusOK {
+		t.Fatalf("outflow spend: got %d %s", w.Code, w.Body)
+	}
+
+	data, err := os.ReadFile(s.cfg.TransLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(rows) != 2 || !strings.HasSuffix(rows[0], ",SPEND,-300,,default,1,,inflow") || !strings.HasSuffix(rows[1], ",SPEND,200,,default,2") {
+		t.Errorf("got log %q, want the inflow spend logged as -300 with its sign", rows)
+	}
+
+	// Both rows read back as amounts taken from the balance
+	if spent, err := s.periodSpent("A", defaultAccountName, s.now()); err != nil || spent != 500 {
+		t.Errorf("spent: got %d, %v; want 500", spent, err)
+	}
+	var amounts []int32
+	if err := scanTransactionLog(s.cfg.TransLogFile, func(t Transaction, _ []string) { amounts = append(amounts, t.Amount) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(amounts) != 2 || amounts[0] != 300 || amounts[1] != 200 {
+		t.Errorf("got amounts %v from the log, want [300 200]", amounts)
+	}
+
+	// An exported inflow row imports as the same spend
+	w := serve(s.handleImport, http.MethodPost, "/import", rows[0])
+	if w.Code != http.StatusOK || s.accounts["A"][defaultAccountName].Balance != 200 {
+		t.Errorf("import: got %d %s, balance %d; want 200", w.Code, w.Body, s.accounts["A"][defaultAccountName].Balance)
+	}
+}
+
+func TestParseTransactionSign(t *testing.T) {
+	tests := []struct {
+		record string
+		want   int32
+		ok     bool
+	}{
+		{"2026-01-01,10:00:00,A,SPEND,300,,default,1", 300, true},
+		{"2026-01-01,10:00:00,A,SPEND,300,,default,1,,outflow", 300, true},
+		{"2026-01-01,10:00:00,A,SPEND,-300,,default,1,,inflow", 300, true},
+		{"2026-01-01,10:00:00,A,CREDIT,300,,default,1,,inflow", 300, true},
+		{"2026-01-01,10:00:00,A,SPEND,-2147483648,,default,1,,inflow", 0, false},
+		{"2026-01-01,10:00:00,A,SPEND,300,,default,1,,sideways", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTransaction(strings.Split(tt.record, ","))
+		if ok != tt.ok || got.Amount != tt.want {
+			t.Errorf("parseTransaction(%q) = %d, %v; want %d, %v", tt.record, got.Amount, ok, tt.want, tt.ok)
+		}
+	}
+}
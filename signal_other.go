@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyMaintenance does nothing: SIGUSR1 only exists on Unix systems, so
+// elsewhere maintenance mode can only be toggled via /admin/maintenance.
+func notifyMaintenance(c chan<- os.Signal) {}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyMaintenance relays SIGUSR1, which toggles maintenance mode, to c.
+func notifyMaintenance(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}